@@ -0,0 +1,516 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"os"
+	"strings"
+	"time"
+)
+
+// bearer token for the admin api, the admin api is disabled when this is empty
+var AdminToken = os.Getenv("ADMIN_TOKEN")
+
+// authenticateAdmin is a middleware requiring "Authorization: Bearer <ADMIN_TOKEN>"
+func authenticateAdmin(ctx iris.Context) {
+	if AdminToken == "" {
+		ctx.StopWithStatus(iris.StatusNotFound)
+		return
+	}
+
+	token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+
+	if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(AdminToken)) != 1 {
+		ctx.StopWithStatus(iris.StatusUnauthorized)
+		return
+	}
+
+	ctx.Next()
+}
+
+// siteRequest creates or updates a site, empty fields are left unchanged and a negative number of retention days
+// resets the retention to the global default
+type siteRequest struct {
+	Domain               string       `json:"domain"`
+	Timezone             string       `json:"timezone"`
+	Aliases              []string     `json:"aliases"`
+	InternalTraffic      string       `json:"internal_traffic"`
+	VisitorIdMode        string       `json:"visitor_id_mode"`
+	IpPolicy             string       `json:"ip_policy"`
+	PrivacySignals       string       `json:"privacy_signals"`
+	SchemaMode           string       `json:"schema_mode"`
+	PathOptions          *pathOptions `json:"path_options"`
+	TrafficRetentionDays *int         `json:"traffic_retention_days"`
+	EventsRetentionDays  *int         `json:"events_retention_days"`
+}
+
+type exclusionRequest struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type pathRuleRequest struct {
+	Pattern  string `json:"pattern"`
+	Template string `json:"template"`
+}
+
+type aliasRequest struct {
+	Alias string `json:"alias"`
+}
+
+func registerAdminRoutes(app *iris.Application) {
+	admin := app.Party("/admin", authenticateAdmin)
+
+	admin.Get("/sites", handleListSites)
+	admin.Post("/sites", handleCreateSite)
+	admin.Get("/sites/{domain}", handleGetSite)
+	admin.Put("/sites/{domain}", handleUpdateSite)
+	admin.Delete("/sites/{domain}", handleDeleteSite)
+	admin.Post("/sites/{domain}/aliases", handleAddSiteAlias)
+	admin.Delete("/sites/{domain}/aliases/{alias}", handleRemoveSiteAlias)
+	admin.Get("/sites/{domain}/exclusions", handleListExclusions)
+	admin.Post("/sites/{domain}/exclusions", handleAddExclusion)
+	admin.Delete("/sites/{domain}/exclusions/{id:int}", handleRemoveExclusion)
+	admin.Get("/sites/{domain}/path-rules", handleListPathRules)
+	admin.Post("/sites/{domain}/path-rules", handleAddPathRule)
+	admin.Delete("/sites/{domain}/path-rules/{id:int}", handleRemovePathRule)
+	admin.Post("/sites/{domain}/path-rules/apply", handleApplyPathRules)
+	admin.Get("/sites/{domain}/schemas", handleListEventSchemas)
+	admin.Put("/sites/{domain}/schemas/{event}", handleSetEventSchema)
+	admin.Delete("/sites/{domain}/schemas/{event}", handleRemoveEventSchema)
+	admin.Get("/sites/{domain}/events/observed", handleObservedEvents)
+	admin.Get("/sites/{domain}/quarantine", handleListQuarantine)
+	admin.Post("/subjects/export", handleExportSubject)
+	admin.Post("/subjects/erase", handleEraseSubject)
+}
+
+// siteFromPath returns the site named in the path, stopping the request with 404 if there is none
+func siteFromPath(ctx iris.Context) (*site, bool) {
+	s, ok := registry.resolve(ctx.Params().Get("domain"))
+
+	if !ok {
+		ctx.StopWithError(iris.StatusNotFound, fmt.Errorf("no site %s", ctx.Params().Get("domain")))
+		return nil, false
+	}
+
+	return s, true
+}
+
+func handleListSites(ctx iris.Context) {
+	_ = ctx.JSON(registry.list())
+}
+
+func handleGetSite(ctx iris.Context) {
+	if s, ok := siteFromPath(ctx); ok {
+		_ = ctx.JSON(s)
+	}
+}
+
+// settings returns the settings present in a site request
+func (r *siteRequest) settings() []siteSetting {
+	settings := make([]siteSetting, 0)
+
+	for _, field := range []struct {
+		value   string
+		setting func(string) siteSetting
+	}{
+		{r.Timezone, timezoneSetting},
+		{r.InternalTraffic, internalTrafficSetting},
+		{r.VisitorIdMode, visitorIdModeSetting},
+		{r.IpPolicy, ipPolicySetting},
+		{r.PrivacySignals, privacySignalsSetting},
+		{r.SchemaMode, schemaModeSetting},
+	} {
+		if field.value != "" {
+			settings = append(settings, field.setting(field.value))
+		}
+	}
+
+	if r.PathOptions != nil {
+		settings = append(settings, pathOptionsSettings(*r.PathOptions)...)
+	}
+
+	for _, field := range []struct {
+		kind string
+		days *int
+	}{
+		{retentionTraffic, r.TrafficRetentionDays},
+		{retentionEvents, r.EventsRetentionDays},
+	} {
+		if field.days == nil {
+			continue
+		}
+
+		if *field.days < 0 {
+			field.days = nil
+		}
+
+		settings = append(settings, retentionSetting(field.kind, field.days))
+	}
+
+	return settings
+}
+
+func handleCreateSite(ctx iris.Context) {
+	var body siteRequest
+	err := ctx.ReadJSON(&body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	domain := normalizeDomain(body.Domain)
+
+	if domain == "" {
+		ctx.StopWithError(iris.StatusBadRequest, fmt.Errorf("domain is required"))
+		return
+	}
+
+	aliases := make([]string, len(body.Aliases))
+
+	for i, alias := range body.Aliases {
+		aliases[i] = normalizeDomain(alias)
+	}
+
+	err = createSite(db, domain, aliases, body.settings()...)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	s, _ := registry.resolve(domain)
+	ctx.StatusCode(iris.StatusCreated)
+	_ = ctx.JSON(s)
+}
+
+func handleUpdateSite(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	var body siteRequest
+	err := ctx.ReadJSON(&body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	err = setSite(db, s.Domain, body.settings()...)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	s, _ = registry.resolve(s.Domain)
+	_ = ctx.JSON(s)
+}
+
+func handleDeleteSite(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	err := deleteSite(db, s.Domain)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+func handleAddSiteAlias(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	var body aliasRequest
+	err := ctx.ReadJSON(&body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	err = addSiteAlias(db, s.Domain, normalizeDomain(body.Alias))
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	s, _ = registry.resolve(s.Domain)
+	_ = ctx.JSON(s)
+}
+
+func handleRemoveSiteAlias(ctx iris.Context) {
+	if _, ok := siteFromPath(ctx); !ok {
+		return
+	}
+
+	err := removeSiteAlias(db, normalizeDomain(ctx.Params().Get("alias")))
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusNotFound, err)
+		return
+	}
+
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+func handleListExclusions(ctx iris.Context) {
+	if s, ok := siteFromPath(ctx); ok {
+		_ = ctx.JSON(s.Exclusions)
+	}
+}
+
+func handleAddExclusion(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	var body exclusionRequest
+	err := ctx.ReadJSON(&body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	rule, err := addExclusionRule(db, s.Domain, body.Kind, body.Value)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	ctx.StatusCode(iris.StatusCreated)
+	_ = ctx.JSON(rule)
+}
+
+func handleRemoveExclusion(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	err := removeExclusionRule(db, s.Domain, ctx.Params().GetIntDefault("id", 0))
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusNotFound, err)
+		return
+	}
+
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+func handleListPathRules(ctx iris.Context) {
+	if s, ok := siteFromPath(ctx); ok {
+		_ = ctx.JSON(s.PathRules)
+	}
+}
+
+func handleAddPathRule(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	var body pathRuleRequest
+	err := ctx.ReadJSON(&body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	rule, err := addPathRule(db, s.Domain, body.Pattern, body.Template)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	ctx.StatusCode(iris.StatusCreated)
+	_ = ctx.JSON(rule)
+}
+
+func handleRemovePathRule(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	err := removePathRule(db, s.Domain, ctx.Params().GetIntDefault("id", 0))
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusNotFound, err)
+		return
+	}
+
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+// handleApplyPathRules re-applies the path rules of a site to its stored rows
+func handleApplyPathRules(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	updated, err := renormalizePaths(db, s)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+
+	_ = ctx.JSON(iris.Map{"updated": updated})
+}
+
+func handleListEventSchemas(ctx iris.Context) {
+	if s, ok := siteFromPath(ctx); ok {
+		_ = ctx.JSON(s.listEventSchemas())
+	}
+}
+
+// handleSetEventSchema creates or replaces the schema of an event, the body is the json schema
+func handleSetEventSchema(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	body, err := ctx.GetBody()
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	eventName := ctx.Params().Get("event")
+	err = setEventSchema(db, s.Domain, eventName, body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	s, _ = registry.resolve(s.Domain)
+	_ = ctx.JSON(s.Schemas[eventName])
+}
+
+func handleRemoveEventSchema(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	err := removeEventSchema(db, s.Domain, ctx.Params().Get("event"))
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusNotFound, err)
+		return
+	}
+
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+// handleObservedEvents lists the event names and properties stored in the last "days" days, 30 by default
+func handleObservedEvents(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	days := ctx.URLParamIntDefault("days", 30)
+	observed, err := s.observeEvents(db, time.Now().UTC().AddDate(0, 0, -days))
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+
+	_ = ctx.JSON(observed)
+}
+
+func handleListQuarantine(ctx iris.Context) {
+	s, ok := siteFromPath(ctx)
+
+	if !ok {
+		return
+	}
+
+	events, err := listQuarantinedEvents(db, s.Domain)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+
+	_ = ctx.JSON(events)
+}
+
+// adminActor identifies the caller of the admin api in the audit log
+func adminActor(ctx iris.Context) string {
+	return "admin api " + ctx.RemoteAddr()
+}
+
+func handleExportSubject(ctx iris.Context) {
+	var body subject
+	err := ctx.ReadJSON(&body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	data, err := exportSubject(db, adminActor(ctx), body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	_ = ctx.JSON(data)
+}
+
+func handleEraseSubject(ctx iris.Context) {
+	var body subject
+	err := ctx.ReadJSON(&body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	erasure, err := eraseSubject(db, adminActor(ctx), body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	_ = ctx.JSON(erasure)
+}
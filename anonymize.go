@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+// age after which full client ips in monthly_traffic are truncated, disabled when zero
+var IpAnonymizeAfter = envDuration("IP_ANONYMIZE_AFTER", 0)
+
+// how often the anonymization job looks for rows older than IP_ANONYMIZE_AFTER
+var IpAnonymizeInterval = envDuration("IP_ANONYMIZE_INTERVAL", time.Hour)
+
+// number of rows updated per statement by the anonymization job
+var IpAnonymizeBatchSize = envInt("IP_ANONYMIZE_BATCH_SIZE", 10000)
+
+// what is stored of client ips
+const (
+	ipPolicyFull     = "full"
+	ipPolicyTruncate = "truncate"
+	ipPolicyDrop     = "drop"
+)
+
+// prefix lengths kept when truncating an address
+const (
+	ipv4PrefixBits = 24
+	ipv6PrefixBits = 48
+)
+
+// truncateIp zeroes the host part of an address, keeping a /24 of ipv4 and a /48 of ipv6 addresses.
+// Strings that aren't addresses are returned as is.
+func truncateIp(address string) string {
+	ip := net.ParseIP(address)
+
+	if ip == nil {
+		return address
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(ipv4PrefixBits, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(ipv6PrefixBits, 128)).String()
+}
+
+// anonymizeIps applies an ip policy to the client ip chain, returning the values stored in the ip and ips columns
+// and whether they are anonymized
+func anonymizeIps(policy string, clientIps []string) (interface{}, interface{}, bool) {
+	switch policy {
+	case ipPolicyDrop:
+		return nil, nil, true
+	case ipPolicyTruncate:
+		truncated := make([]string, len(clientIps))
+
+		for i, ip := range clientIps {
+			truncated[i] = truncateIp(ip)
+		}
+
+		clientIps = truncated
+	}
+
+	var ips interface{} = nil
+
+	if len(clientIps) > 1 {
+		ips = pq.Array(clientIps[1:])
+	}
+
+	return clientIps[0], ips, policy == ipPolicyTruncate
+}
+
+// sqlTruncateIp is the sql equivalent of truncateIp for the inet expression x
+func sqlTruncateIp(x string) string {
+	return fmt.Sprintf("host(network(set_masklen(%[1]s, CASE family(%[1]s) WHEN 4 THEN %[2]d ELSE %[3]d END)))::inet", x, ipv4PrefixBits, ipv6PrefixBits)
+}
+
+// anonymizeOldTraffic truncates the ips of rows older than cutoff, a batch at a time, and returns the number of rows updated
+func anonymizeOldTraffic(db *sql.DB, cutoff time.Time) (int64, error) {
+	query := "UPDATE public.monthly_traffic SET ip = " + sqlTruncateIp("ip") +
+		", ips = CASE WHEN ips IS NULL THEN NULL ELSE ARRAY(SELECT " + sqlTruncateIp("x") + " FROM unnest(ips) WITH ORDINALITY AS t(x, n) ORDER BY n) END" +
+		", ip_anonymized = true" +
+		" WHERE ctid IN (SELECT ctid FROM public.monthly_traffic WHERE NOT ip_anonymized AND timestamp < $1 LIMIT $2)"
+
+	var updated int64 = 0
+
+	for {
+		res, err := db.Exec(query, cutoff, IpAnonymizeBatchSize)
+
+		if err != nil {
+			return updated, err
+		}
+
+		n, _ := res.RowsAffected()
+		updated += n
+
+		if n < int64(IpAnonymizeBatchSize) {
+			return updated, nil
+		}
+	}
+}
+
+// anonymizeIpsPeriodically runs anonymizeOldTraffic every IP_ANONYMIZE_INTERVAL if IP_ANONYMIZE_AFTER is set
+func anonymizeIpsPeriodically(db *sql.DB) {
+	if IpAnonymizeAfter <= 0 {
+		return
+	}
+
+	for {
+		updated, err := anonymizeOldTraffic(db, time.Now().Add(-IpAnonymizeAfter))
+
+		if err != nil {
+			metricDbErrors.inc("anonymize")
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Error("Failed to anonymize ips")
+		} else if updated > 0 {
+			log.WithFields(log.Fields{"rows": updated}).Info("Anonymized ips")
+		}
+
+		time.Sleep(IpAnonymizeInterval)
+	}
+}
+
+func ipPolicySetting(policy string) siteSetting {
+	if policy != ipPolicyFull && policy != ipPolicyTruncate && policy != ipPolicyDrop {
+		return siteSetting{err: fmt.Errorf("ip policy must be %s, %s or %s", ipPolicyFull, ipPolicyTruncate, ipPolicyDrop)}
+	}
+
+	return siteSetting{column: "ip_policy", value: policy}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestTruncateIp(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"203.0.113.195", "203.0.113.0"},
+		{"10.1.2.3", "10.1.2.0"},
+		{"::ffff:203.0.113.195", "203.0.113.0"},
+		{"2001:db8:85a3:8d3:1319:8a2e:370:7348", "2001:db8:85a3::"},
+		{"2001:db8::1", "2001:db8::"},
+		{"unknown", "unknown"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := truncateIp(tt.address); got != tt.want {
+			t.Errorf("truncateIp(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
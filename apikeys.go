@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long the previous keys of a site keep working after the keys are rotated
+var KeyRotationGrace = envDuration("KEY_ROTATION_GRACE", 24*time.Hour)
+
+// max difference between the timestamp of a signed request and the server clock
+var SignatureTolerance = envDuration("INGEST_SIGNATURE_TOLERANCE", 5*time.Minute)
+
+// how long a looked up key is trusted before it is read from the database again,
+// this is also the longest a revoked key can keep working
+const apiKeyCacheTtl = 30 * time.Second
+
+// context value holding the domain of the authenticated key
+const authenticatedDomainKey = "authenticatedDomain"
+
+var errUnauthorized = errors.New("missing or invalid api key")
+
+type apiKey struct {
+	Id      string     `json:"id"`
+	Domain  string     `json:"domain"`
+	Secret  string     `json:"-"`
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked"`
+}
+
+func (k *apiKey) active(now time.Time) bool {
+	return k.Revoked == nil || k.Revoked.After(now)
+}
+
+// Token is the value clients send as a bearer token
+func (k *apiKey) Token() string {
+	return k.Id + "." + k.Secret
+}
+
+type cachedApiKey struct {
+	key     *apiKey
+	fetched time.Time
+}
+
+var apiKeyCache = struct {
+	sync.Mutex
+	keys map[string]cachedApiKey
+}{keys: make(map[string]cachedApiKey)}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// lookupApiKey returns the key with the given id, or nil if there is no such key. Only keys that exist are cached,
+// ids sent by clients are arbitrary so caching misses would let the cache grow without bound.
+func lookupApiKey(db *sql.DB, id string) (*apiKey, error) {
+	apiKeyCache.Lock()
+	cached, ok := apiKeyCache.keys[id]
+	apiKeyCache.Unlock()
+
+	if ok && time.Since(cached.fetched) < apiKeyCacheTtl {
+		return cached.key, nil
+	}
+
+	var k apiKey
+	var revoked sql.NullTime
+	err := db.QueryRow("SELECT id, domain, secret, created, revoked FROM public.site_api_keys WHERE id = $1", id).Scan(&k.Id, &k.Domain, &k.Secret, &k.Created, &revoked)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked.Valid {
+		k.Revoked = &revoked.Time
+	}
+
+	apiKeyCache.Lock()
+	apiKeyCache.keys[id] = cachedApiKey{key: &k, fetched: time.Now()}
+	apiKeyCache.Unlock()
+
+	return &k, nil
+}
+
+func listApiKeys(db *sql.DB, domain string) ([]apiKey, error) {
+	rows, err := db.Query("SELECT id, domain, created, revoked FROM public.site_api_keys WHERE domain = $1 ORDER BY created", domain)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]apiKey, 0)
+
+	for rows.Next() {
+		var k apiKey
+		var revoked sql.NullTime
+
+		err := rows.Scan(&k.Id, &k.Domain, &k.Created, &revoked)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if revoked.Valid {
+			k.Revoked = &revoked.Time
+		}
+
+		result = append(result, k)
+	}
+
+	return result, rows.Err()
+}
+
+// createApiKey adds a new key for a registered site, aliases are resolved to their site
+func createApiKey(db *sql.DB, domain string) (*apiKey, error) {
+	s, ok := registry.resolve(domain)
+
+	if !ok {
+		return nil, fmt.Errorf("no site %s", domain)
+	}
+
+	domain = s.Domain
+
+	id, err := randomHex(8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomHex(32)
+
+	if err != nil {
+		return nil, err
+	}
+
+	k := apiKey{Id: "tk_" + id, Domain: domain, Secret: secret}
+
+	err = db.QueryRow("INSERT INTO public.site_api_keys (id, domain, secret) VALUES ($1, $2, $3) RETURNING created", k.Id, k.Domain, k.Secret).Scan(&k.Created)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// rotateApiKeys creates a new key for domain and lets all other active keys expire after KeyRotationGrace
+func rotateApiKeys(db *sql.DB, domain string) (*apiKey, error) {
+	k, err := createApiKey(db, domain)
+
+	if err != nil {
+		return nil, err
+	}
+
+	domain = k.Domain
+
+	_, err = db.Exec("UPDATE public.site_api_keys SET revoked = $1 WHERE domain = $2 AND id <> $3 AND (revoked IS NULL OR revoked > $1)",
+		time.Now().UTC().Add(KeyRotationGrace), domain, k.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// revokeApiKey stops a key from working immediately, or within apiKeyCacheTtl on other instances
+func revokeApiKey(db *sql.DB, id string) error {
+	res, err := db.Exec("UPDATE public.site_api_keys SET revoked = $1 WHERE id = $2", time.Now().UTC(), id)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no key with id %s", id)
+	}
+
+	apiKeyCache.Lock()
+	delete(apiKeyCache.keys, id)
+	apiKeyCache.Unlock()
+
+	return nil
+}
+
+func activeApiKey(id string) (*apiKey, error) {
+	key, err := lookupApiKey(db, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil || !key.active(time.Now().UTC()) {
+		return nil, errUnauthorized
+	}
+
+	return key, nil
+}
+
+// verifyBearer checks a token of the form "<key id>.<secret>"
+func verifyBearer(token string) (*apiKey, error) {
+	id, secret, ok := strings.Cut(token, ".")
+
+	if !ok {
+		return nil, errUnauthorized
+	}
+
+	key, err := activeApiKey(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(key.Secret)) != 1 {
+		return nil, errUnauthorized
+	}
+
+	return key, nil
+}
+
+// verifySignature checks a hex encoded HMAC-SHA256 of "<timestamp>.<body>" made with the secret of the key
+func verifySignature(id string, timestamp string, signature string, body []byte) (*apiKey, error) {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil {
+		return nil, errUnauthorized
+	}
+
+	if math.Abs(time.Since(time.Unix(ts, 0)).Seconds()) > SignatureTolerance.Seconds() {
+		return nil, fmt.Errorf("request timestamp is outside the allowed window")
+	}
+
+	sig, err := hex.DecodeString(signature)
+
+	if err != nil {
+		return nil, errUnauthorized
+	}
+
+	key, err := activeApiKey(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errUnauthorized
+	}
+
+	return key, nil
+}
+
+// authenticateIngest is a middleware requiring either "Authorization: Bearer <key id>.<secret>" or a signed
+// request with the X-Trackma-Key, X-Trackma-Timestamp and X-Trackma-Signature headers.
+func authenticateIngest(ctx iris.Context) {
+	var key *apiKey
+	var err error
+
+	if token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer "); ok {
+		key, err = verifyBearer(strings.TrimSpace(token))
+	} else if signature := ctx.GetHeader("X-Trackma-Signature"); signature != "" {
+		// the body has to be read before the signature can be checked, so its size is limited to the largest
+		// body an ingest endpoint accepts
+		var body []byte
+		body, err = io.ReadAll(http.MaxBytesReader(ctx.ResponseWriter(), ctx.Request().Body, maxBatchSize))
+
+		if err == nil {
+			ctx.Request().Body = io.NopCloser(bytes.NewReader(body))
+			key, err = verifySignature(ctx.GetHeader("X-Trackma-Key"), ctx.GetHeader("X-Trackma-Timestamp"), signature, body)
+		}
+	} else {
+		err = errUnauthorized
+	}
+
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		ctx.StopWithError(iris.StatusRequestEntityTooLarge, fmt.Errorf("request body is larger than %d bytes", maxBatchSize))
+		return
+	}
+
+	if err != nil {
+		if !errors.Is(err, errUnauthorized) {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Warn("Failed to authenticate ingest request")
+		}
+
+		ctx.StopWithError(iris.StatusUnauthorized, errUnauthorized)
+		return
+	}
+
+	ctx.Values().Set(authenticatedDomainKey, key.Domain)
+	ctx.Next()
+}
+
+// authorizeDomain checks that the authenticated key belongs to the domain of an ingest request
+func authorizeDomain(ctx iris.Context, domain string) error {
+	if ctx.Values().GetString(authenticatedDomainKey) != normalizeDomain(domain) {
+		return fmt.Errorf("api key is not valid for domain %s", domain)
+	}
+
+	return nil
+}
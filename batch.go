@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// maximum number of items accepted in a single batch request
+const maxBatchItems = 1000
+
+// maximum size in bytes of a batch request body
+const maxBatchSize = 8 * 1024 * 1024
+
+type batchItemResult struct {
+	Index    int    `json:"index"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []batchItemResult `json:"results"`
+}
+
+// splitBatchBody returns the raw json of every item in the body. A json body must be an array
+// of ingest requests, a ndjson body contains one ingest request per line. Blank lines are skipped.
+func splitBatchBody(contentType string, body []byte) ([]json.RawMessage, error) {
+	switch contentType {
+	case "application/json":
+		var items []json.RawMessage
+		err := json.Unmarshal(body, &items)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return items, nil
+	case "application/x-ndjson", "application/ndjson":
+		items := make([]json.RawMessage, 0)
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+
+			if len(line) == 0 {
+				continue
+			}
+
+			items = append(items, append(json.RawMessage(nil), line...))
+		}
+
+		return items, scanner.Err()
+	}
+
+	return nil, fmt.Errorf("unsupported content type %s", contentType)
+}
+
+func handleIngestBatch(ctx iris.Context) {
+	contentType, _, err := mime.ParseMediaType(ctx.GetHeader("Content-Type"))
+
+	if err != nil || (contentType != "application/json" && contentType != "application/x-ndjson" && contentType != "application/ndjson") {
+		ctx.StatusCode(iris.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(ctx.ResponseWriter(), ctx.Request().Body, maxBatchSize))
+
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		ctx.StopWithError(iris.StatusRequestEntityTooLarge, fmt.Errorf("batch is larger than %d bytes", maxBatchSize))
+		return
+	}
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	items, err := splitBatchBody(contentType, body)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	if len(items) == 0 {
+		ctx.StopWithError(iris.StatusBadRequest, fmt.Errorf("batch is empty"))
+		return
+	}
+
+	if len(items) > maxBatchItems {
+		ctx.StopWithError(iris.StatusRequestEntityTooLarge, fmt.Errorf("batch contains %d items, max is %d", len(items), maxBatchItems))
+		return
+	}
+
+	response := batchResponse{
+		Results: make([]batchItemResult, len(items)),
+	}
+
+	var dropped = 0
+
+	for i, item := range items {
+		result := batchItemResult{Index: i}
+
+		var ingestBody IngestRequest
+		err := json.Unmarshal(item, &ingestBody)
+		reason := rejectInvalid
+
+		if err == nil {
+			resolveClientIp(&ingestBody, ClientIpMode)
+			err = validateIngestRequest(&ingestBody)
+			reason = validationRejectReason(err)
+		}
+
+		if err == nil {
+			err = authorizeDomain(ctx, ingestBody.Domain)
+			reason = rejectUnauthorized
+		}
+
+		if err != nil {
+			rejectEvent(reason)
+			result.Error = err.Error()
+			response.Rejected++
+		} else if !enqueue(ingestBody) {
+			result.Error = "pipeline is full"
+			response.Rejected++
+			dropped++
+		} else {
+			result.Accepted = true
+			response.Accepted++
+		}
+
+		response.Results[i] = result
+	}
+
+	if dropped > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(IngestRetryAfter))
+
+		// nothing could be queued, tell the client to back off and send the batch again
+		if response.Accepted == 0 {
+			ctx.StatusCode(iris.StatusServiceUnavailable)
+		}
+	}
+
+	_ = ctx.JSON(response)
+}
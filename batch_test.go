@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitBatchBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []string
+		err         string
+	}{
+		{"json array", "application/json", `[{"domain": "a.com"}, {"domain": "b.com"}]`, []string{`{"domain": "a.com"}`, `{"domain": "b.com"}`}, ""},
+		{"empty json array", "application/json", `[]`, []string{}, ""},
+		{"json object", "application/json", `{"domain": "a.com"}`, nil, "cannot unmarshal object"},
+		{"invalid json", "application/json", `[{"domain": `, nil, "unexpected end of JSON input"},
+		{"ndjson", "application/x-ndjson", "{\"domain\": \"a.com\"}\n{\"domain\": \"b.com\"}\n", []string{`{"domain": "a.com"}`, `{"domain": "b.com"}`}, ""},
+		{"ndjson skips blank lines", "application/ndjson", "\n  {\"domain\": \"a.com\"}  \n\n\r\n{\"domain\": \"b.com\"}", []string{`{"domain": "a.com"}`, `{"domain": "b.com"}`}, ""},
+		{"ndjson lines aren't parsed", "application/x-ndjson", "not json\n", []string{"not json"}, ""},
+		{"unsupported content type", "text/plain", `[]`, nil, "unsupported content type text/plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := splitBatchBody(tt.contentType, []byte(tt.body))
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("splitBatchBody() error = %v, want it to contain %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("splitBatchBody() error = %v", err)
+			}
+
+			if len(items) != len(tt.want) {
+				t.Fatalf("got %d items, want %d", len(items), len(tt.want))
+			}
+
+			for i, item := range items {
+				if string(item) != tt.want[i] {
+					t.Errorf("item %d = %s, want %s", i, item, tt.want[i])
+				}
+			}
+		})
+	}
+}
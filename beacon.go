@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/kataras/iris/v12"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// max size of a beacon body in bytes
+const maxBeaconSize = 64 * 1024
+
+// beaconRequest is what the tracker script sends. Client ip and user agent are never taken
+// from the payload, they are read from the http request instead.
+type beaconRequest struct {
+	Domain     string `json:"domain"`
+	Path       string `json:"path"`
+	Query      string `json:"query"`
+	EventName  string `json:"eventName"`
+	SessionId  string `json:"sessionId"`
+	Referrer   string `json:"referrer"`
+	Duration   int64  `json:"duration"`
+	StatusCode int16  `json:"statusCode"`
+	EventData  string `json:"eventData"`
+	Consent    string `json:"consent"`
+}
+
+// browserClientIps returns the client ip chain of a browser request, the addresses of the forwarding headers
+// followed by the peer address
+func browserClientIps(ctx iris.Context) []string {
+	return append(forwardedFor(ctx.GetHeader("Forwarded"), ctx.GetHeader("X-Forwarded-For")), ctx.RemoteAddr())
+}
+
+// browserPrivacySignals returns whether the browser sent the do not track and global privacy control headers
+func browserPrivacySignals(ctx iris.Context) (bool, bool) {
+	return ctx.GetHeader("DNT") == "1", ctx.GetHeader("Sec-GPC") == "1"
+}
+
+// allowOrigin writes the cors headers if the request origin is one of the hosts of the site of domain, so a page can
+// only send beacons for its own site. Preflight requests don't carry the domain yet, an empty domain allows the hosts
+// of every registered site. Browsers send an origin header with every beacon and preflight, requests without one
+// don't come from a page of the site and are refused.
+func allowOrigin(ctx iris.Context, domain string) bool {
+	origin := ctx.GetHeader("Origin")
+
+	if origin == "" {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+
+	if err != nil {
+		return false
+	}
+
+	host := normalizeDomain(u.Hostname())
+
+	if domain == "" {
+		if _, ok := registry.resolve(host); !ok {
+			return false
+		}
+	} else {
+		s, ok := registry.resolve(domain)
+
+		if !ok || !slices.Contains(s.Hosts(), host) {
+			return false
+		}
+	}
+
+	ctx.Header("Access-Control-Allow-Origin", origin)
+	ctx.Header("Access-Control-Allow-Methods", "POST, OPTIONS")
+	ctx.Header("Access-Control-Allow-Headers", "Content-Type")
+	ctx.Header("Access-Control-Max-Age", "86400")
+	ctx.Header("Vary", "Origin")
+
+	return true
+}
+
+func handleBeaconPreflight(ctx iris.Context) {
+	if !allowOrigin(ctx, "") {
+		ctx.StatusCode(iris.StatusForbidden)
+		return
+	}
+
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+// handleBeacon ingests events sent with navigator.sendBeacon. Beacons are sent as text/plain
+// so the browser doesn't need a preflight request, the body is json regardless.
+func handleBeacon(ctx iris.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(ctx.ResponseWriter(), ctx.Request().Body, maxBeaconSize))
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	var beacon beaconRequest
+	err = json.Unmarshal(body, &beacon)
+
+	if err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	if !allowOrigin(ctx, beacon.Domain) {
+		ctx.StatusCode(iris.StatusForbidden)
+		return
+	}
+
+	dnt, gpc := browserPrivacySignals(ctx)
+
+	ingestBody := IngestRequest{
+		Domain:          beacon.Domain,
+		Path:            beacon.Path,
+		Query:           strings.TrimPrefix(beacon.Query, "?"),
+		EventName:       beacon.EventName,
+		SessionId:       beacon.SessionId,
+		Referrer:        beacon.Referrer,
+		ClientIp:        browserClientIps(ctx),
+		ClientUserAgent: ctx.GetHeader("User-Agent"),
+		Duration:        beacon.Duration,
+		StatusCode:      beacon.StatusCode,
+		EventData:       beacon.EventData,
+		Dnt:             dnt,
+		Gpc:             gpc,
+		Consent:         beacon.Consent,
+	}
+
+	resolveClientIp(&ingestBody, clientIpRightmostUntrusted)
+	err = validateIngestRequest(&ingestBody)
+
+	if err != nil {
+		rejectEvent(validationRejectReason(err))
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+
+	if !enqueue(ingestBody) {
+		stopPipelineFull(ctx)
+		return
+	}
+
+	ctx.StatusCode(iris.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"github.com/kataras/iris/v12"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBeaconOrigin(t *testing.T) {
+	withSites(t,
+		&site{Domain: "example.com", Aliases: []string{"example.org"}},
+		&site{Domain: "other.com"},
+	)
+
+	app := iris.New()
+	app.Post("/beacon", handleBeacon)
+	app.Options("/beacon", handleBeaconPreflight)
+
+	if err := app.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the event name is missing, so a beacon that passes the origin check is rejected by validation instead of queued
+	body := `{"domain": "example.com", "path": "/"}`
+
+	tests := []struct {
+		name      string
+		method    string
+		origin    string
+		forbidden bool
+	}{
+		{"no origin", http.MethodPost, "", true},
+		{"origin of the site", http.MethodPost, "https://example.com", false},
+		{"origin of an alias", http.MethodPost, "https://example.org", false},
+		{"origin of another site", http.MethodPost, "https://other.com", true},
+		{"unregistered origin", http.MethodPost, "https://evil.net", true},
+		{"preflight without origin", http.MethodOptions, "", true},
+		{"preflight of a registered site", http.MethodOptions, "https://other.com", false},
+		{"preflight of an unregistered origin", http.MethodOptions, "https://evil.net", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, "/beacon", bytes.NewBufferString(body))
+
+			if tt.origin != "" {
+				request.Header.Set("Origin", tt.origin)
+			}
+
+			recorder := httptest.NewRecorder()
+			app.ServeHTTP(recorder, request)
+
+			if (recorder.Code == http.StatusForbidden) != tt.forbidden {
+				t.Fatalf("status = %d, want forbidden %v", recorder.Code, tt.forbidden)
+			}
+
+			if !tt.forbidden && recorder.Header().Get("Access-Control-Allow-Origin") != tt.origin {
+				t.Fatalf("Access-Control-Allow-Origin = %q, want %q", recorder.Header().Get("Access-Control-Allow-Origin"), tt.origin)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// optional file with extra user agent patterns, one case-insensitive substring per line
+var BotPatternsFile = os.Getenv("BOT_PATTERNS_FILE")
+
+// optional file with datacenter ip ranges in cidr notation, one per line
+var DatacenterCidrsFile = os.Getenv("DATACENTER_CIDRS_FILE")
+
+// reasons an event is classified as a bot
+const (
+	botReasonUserAgent      = "user_agent"
+	botReasonEmptyUserAgent = "empty_user_agent"
+	botReasonHeadless       = "headless"
+	botReasonDatacenter     = "datacenter"
+)
+
+// user agent substrings of crawlers, monitors, scripts and http libraries
+var defaultBotPatterns = []string{
+	"crawl", "spider", "slurp", "archiver", "indexer", "scraper", "scrapy",
+	"facebookexternalhit", "embedly", "quora link preview", "whatsapp", "telegram", "skypeuripreview",
+	"bingpreview", "google-inspectiontool", "google-read-aloud", "mediapartners-google", "adsbot",
+	"lighthouse", "pagespeed", "gtmetrix", "pingdom", "uptimerobot", "statuscake", "site24x7",
+	"newrelicpinger", "datadog", "monitor", "checkly", "betteruptime",
+	"curl/", "wget/", "python-requests", "python-urllib", "aiohttp", "httpx", "go-http-client",
+	"java/", "okhttp", "apache-httpclient", "libwww-perl", "node-fetch", "axios/", "undici", "postmanruntime",
+	"insomnia", "httpie", "guzzlehttp", "ruby", "dart:io",
+}
+
+// "bot" as a word of its own or at the end of a product token such as googlebot/2.1 or slackbot-linkexpanding,
+// devices such as the cubot phones only have it inside a word
+var botToken = regexp.MustCompile(`(?:^|[^a-z])bot(?:[^a-z]|$)|[a-z]bot[/-]`)
+
+// markers of automated browsers that otherwise look like regular ones
+var headlessMarkers = []string{
+	"headlesschrome", "phantomjs", "puppeteer", "playwright", "selenium", "webdriver", "slimerjs",
+}
+
+type botRules struct {
+	mu          sync.RWMutex
+	patterns    []string
+	datacenters []*net.IPNet
+	modified    map[string]time.Time
+}
+
+var bots = &botRules{
+	patterns: defaultBotPatterns,
+	modified: make(map[string]time.Time),
+}
+
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+// changed reports whether path was modified since it was last loaded
+func (b *botRules) changed(path string) bool {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return false
+	}
+
+	b.mu.RLock()
+	last, ok := b.modified[path]
+	b.mu.RUnlock()
+
+	return !ok || info.ModTime().After(last)
+}
+
+func (b *botRules) markLoaded(path string) {
+	if info, err := os.Stat(path); err == nil {
+		b.mu.Lock()
+		b.modified[path] = info.ModTime()
+		b.mu.Unlock()
+	}
+}
+
+// reload reads the pattern and datacenter files if they changed since the last time they were read
+func (b *botRules) reload() error {
+	if BotPatternsFile != "" && b.changed(BotPatternsFile) {
+		lines, err := readLines(BotPatternsFile)
+
+		if err != nil {
+			return err
+		}
+
+		patterns := append([]string{}, defaultBotPatterns...)
+
+		for _, line := range lines {
+			patterns = append(patterns, strings.ToLower(line))
+		}
+
+		b.mu.Lock()
+		b.patterns = patterns
+		b.mu.Unlock()
+		b.markLoaded(BotPatternsFile)
+
+		log.WithFields(log.Fields{"patterns": len(patterns)}).Info("Loaded bot patterns")
+	}
+
+	if DatacenterCidrsFile != "" && b.changed(DatacenterCidrsFile) {
+		lines, err := readLines(DatacenterCidrsFile)
+
+		if err != nil {
+			return err
+		}
+
+		datacenters := make([]*net.IPNet, 0, len(lines))
+
+		for _, line := range lines {
+			_, network, err := net.ParseCIDR(line)
+
+			if err != nil {
+				log.WithFields(log.Fields{"cidr": line}).Warn("Skipping invalid datacenter range")
+				continue
+			}
+
+			datacenters = append(datacenters, network)
+		}
+
+		b.mu.Lock()
+		b.datacenters = datacenters
+		b.mu.Unlock()
+		b.markLoaded(DatacenterCidrsFile)
+
+		log.WithFields(log.Fields{"ranges": len(datacenters)}).Info("Loaded datacenter ranges")
+	}
+
+	return nil
+}
+
+// refresh picks up changes to the pattern files every SiteRefreshInterval
+func (b *botRules) refresh() {
+	ticker := time.NewTicker(SiteRefreshInterval)
+
+	for range ticker.C {
+		err := b.reload()
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Error("Failed to reload bot rules")
+		}
+	}
+}
+
+// classify returns why a request looks automated, or an empty string if it looks like a person
+func (b *botRules) classify(userAgent string, ip string) string {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+
+	if ua == "" {
+		return botReasonEmptyUserAgent
+	}
+
+	for _, marker := range headlessMarkers {
+		if strings.Contains(ua, marker) {
+			return botReasonHeadless
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if botToken.MatchString(ua) {
+		return botReasonUserAgent
+	}
+
+	for _, pattern := range b.patterns {
+		if strings.Contains(ua, pattern) {
+			return botReasonUserAgent
+		}
+	}
+
+	if len(b.datacenters) > 0 {
+		parsed := net.ParseIP(ip)
+
+		if parsed != nil {
+			for _, network := range b.datacenters {
+				if network.Contains(parsed) {
+					return botReasonDatacenter
+				}
+			}
+		}
+	}
+
+	return ""
+}
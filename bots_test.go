@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassifyBot(t *testing.T) {
+	_, datacenter, _ := net.ParseCIDR("203.0.113.0/24")
+	rules := &botRules{patterns: append([]string{"internal-checker"}, defaultBotPatterns...), datacenters: []*net.IPNet{datacenter}}
+
+	chrome := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+	tests := []struct {
+		name      string
+		userAgent string
+		ip        string
+		want      string
+	}{
+		{"browser", chrome, "198.51.100.1", ""},
+		{"empty user agent", "  ", "198.51.100.1", botReasonEmptyUserAgent},
+		{"headless", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/124.0.0.0 Safari/537.36", "198.51.100.1", botReasonHeadless},
+		{"googlebot", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "198.51.100.1", botReasonUserAgent},
+		{"bingbot", "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", "198.51.100.1", botReasonUserAgent},
+		{"product token with a suffix", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "198.51.100.1", botReasonUserAgent},
+		{"bot on its own", "Some Bot 1.0", "198.51.100.1", botReasonUserAgent},
+		{"cubot phone", "Mozilla/5.0 (Linux; Android 10; CUBOT_X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", "198.51.100.1", ""},
+		{"cubot phone with a space", "Mozilla/5.0 (Linux; Android 9; CUBOT KING KONG 3) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", "198.51.100.1", ""},
+		{"crawler", "Mozilla/5.0 (compatible; archive.org_crawler)", "198.51.100.1", botReasonUserAgent},
+		{"http library", "curl/8.4.0", "198.51.100.1", botReasonUserAgent},
+		{"custom pattern", "Internal-Checker 2.0", "198.51.100.1", botReasonUserAgent},
+		{"datacenter", chrome, "203.0.113.7", botReasonDatacenter},
+		{"invalid ip", chrome, "unknown", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.classify(tt.userAgent, tt.ip); got != tt.want {
+				t.Errorf("classify(%q, %q) = %q, want %q", tt.userAgent, tt.ip, got, tt.want)
+			}
+		})
+	}
+}
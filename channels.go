@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/publicsuffix"
+	"os"
+	"slices"
+	"strings"
+)
+
+// optional json file with channel rules that are checked before the default ones
+var ChannelRulesFile = os.Getenv("CHANNEL_RULES_FILE")
+
+const (
+	channelOrganicSearch = "organic_search"
+	channelSocial        = "social"
+	channelEmail         = "email"
+	channelPaid          = "paid"
+	channelReferral      = "referral"
+	channelDirect        = "direct"
+)
+
+// channelRule assigns a channel to a visit if any of its conditions match. Hosts are matched against the
+// referrer host and its parent domains, a host ending in ".*" matches the domain under any public suffix but
+// none of its subdomains, e.g. "google.*" matches google.com and google.co.uk but not docs.google.com.
+// Mediums and sources are matched case-insensitively against utm_medium and utm_source and params match
+// if the query contains the parameter at all, such as a click id.
+type channelRule struct {
+	Channel string   `json:"channel"`
+	Hosts   []string `json:"hosts"`
+	Mediums []string `json:"mediums"`
+	Sources []string `json:"sources"`
+	Params  []string `json:"params"`
+}
+
+var defaultChannelRules = []channelRule{
+	{
+		Channel: channelPaid,
+		Mediums: []string{"cpc", "ppc", "cpm", "cpv", "cpa", "paid", "paidsearch", "paid_search", "paid-search", "paidsocial", "paid_social", "paid-social", "display", "banner", "retargeting"},
+		Params:  []string{"gclid", "gbraid", "wbraid", "msclkid", "dclid", "ttclid", "li_fat_id"},
+	},
+	{
+		Channel: channelEmail,
+		Mediums: []string{"email", "e-mail", "e_mail", "mail", "newsletter"},
+		Sources: []string{"newsletter", "mailchimp", "klaviyo", "sendgrid"},
+		Hosts:   []string{"mail.google.com", "outlook.live.com", "outlook.office.com", "mail.yahoo.com", "mail.proton.me"},
+	},
+	{
+		Channel: channelSocial,
+		Mediums: []string{"social", "social-network", "social_network", "social-media", "social_media", "sm"},
+		Hosts: []string{
+			"facebook.com", "fb.com", "fb.me", "messenger.com", "instagram.com", "threads.net", "t.co", "twitter.com", "x.com",
+			"linkedin.com", "lnkd.in", "reddit.com", "pinterest.*", "youtube.com", "youtu.be", "tiktok.com", "snapchat.com",
+			"tumblr.com", "vk.com", "discord.com", "discordapp.com", "telegram.org", "t.me", "whatsapp.com", "bsky.app",
+			"mastodon.social", "news.ycombinator.com", "quora.com", "twitch.tv", "weibo.com",
+		},
+	},
+	{
+		Channel: channelOrganicSearch,
+		Mediums: []string{"organic"},
+		Hosts: []string{
+			"google.*", "bing.com", "duckduckgo.com", "yahoo.*", "search.yahoo.com", "search.yahoo.co.jp", "yandex.*", "baidu.com", "ecosia.org", "search.brave.com",
+			"startpage.com", "qwant.com", "ask.com", "aol.com", "naver.com", "seznam.cz", "kagi.com", "perplexity.ai",
+		},
+	},
+}
+
+var channelRules = defaultChannelRules
+
+// loadChannelRules puts the rules from path in front of the default rules
+func loadChannelRules(path string) error {
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	var rules []channelRule
+	err = json.Unmarshal(content, &rules)
+
+	if err != nil {
+		return fmt.Errorf("invalid channel rules: %w", err)
+	}
+
+	for _, r := range rules {
+		if r.Channel == "" {
+			return fmt.Errorf("invalid channel rules: every rule needs a channel")
+		}
+	}
+
+	channelRules = append(rules, defaultChannelRules...)
+
+	return nil
+}
+
+func hostMatches(host string, pattern string) bool {
+	pattern = strings.ToLower(pattern)
+
+	if prefix, ok := strings.CutSuffix(pattern, ".*"); ok {
+		// only suffixes run by registries count, so a private one like blogspot.com doesn't turn
+		// google.blogspot.com into google.*
+		suffix, icann := publicsuffix.PublicSuffix(host)
+
+		return icann && host == prefix+"."+suffix
+	}
+
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+func containsFold(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(v string) bool {
+		return strings.EqualFold(v, value)
+	})
+}
+
+func (r *channelRule) matches(referrerHost string, params *map[string]interface{}) bool {
+	if referrerHost != "" {
+		for _, pattern := range r.Hosts {
+			if hostMatches(referrerHost, pattern) {
+				return true
+			}
+		}
+	}
+
+	if params == nil {
+		return false
+	}
+
+	if medium, ok := queryParam(params, "utm_medium"); ok && containsFold(r.Mediums, medium) {
+		return true
+	}
+
+	if source, ok := queryParam(params, "utm_source"); ok && containsFold(r.Sources, source) {
+		return true
+	}
+
+	for _, p := range r.Params {
+		if _, ok := (*params)[p]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// classifyChannel returns the channel of a visit given the external referrer host, empty if the visit
+// wasn't referred by another site, and the query parameters of the landing page
+func classifyChannel(referrerHost string, params *map[string]interface{}) string {
+	referrerHost = strings.TrimPrefix(strings.ToLower(referrerHost), "www.")
+
+	for _, r := range channelRules {
+		if r.matches(referrerHost, params) {
+			return r.Channel
+		}
+	}
+
+	if referrerHost != "" {
+		return channelReferral
+	}
+
+	return channelDirect
+}
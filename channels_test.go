@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestHostMatches(t *testing.T) {
+	tests := []struct {
+		host    string
+		pattern string
+		want    bool
+	}{
+		{"google.com", "google.*", true},
+		{"google.co.uk", "google.*", true},
+		{"google.de", "google.*", true},
+		{"docs.google.com", "google.*", false},
+		{"google.blogspot.com", "google.*", false},
+		{"notgoogle.com", "google.*", false},
+		{"google.com.evil.net", "google.*", false},
+		{"reddit.com", "reddit.com", true},
+		{"old.reddit.com", "reddit.com", true},
+		{"notreddit.com", "reddit.com", false},
+		{"uk.search.yahoo.com", "search.yahoo.com", true},
+	}
+
+	for _, tt := range tests {
+		if got := hostMatches(tt.host, tt.pattern); got != tt.want {
+			t.Errorf("hostMatches(%q, %q) = %v, want %v", tt.host, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyChannel(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		params map[string]interface{}
+		want   string
+	}{
+		{"direct", "", nil, channelDirect},
+		{"search engine", "www.google.com", nil, channelOrganicSearch},
+		{"country search engine", "www.google.co.uk", nil, channelOrganicSearch},
+		{"google subdomain", "docs.google.com", nil, channelReferral},
+		{"google mail", "mail.google.com", nil, channelEmail},
+		{"yahoo search", "uk.search.yahoo.com", nil, channelOrganicSearch},
+		{"social", "l.facebook.com", nil, channelSocial},
+		{"referral", "example.org", nil, channelReferral},
+		{"paid click id wins over the referrer", "www.google.com", map[string]interface{}{"gclid": "abc"}, channelPaid},
+		{"medium", "", map[string]interface{}{"utm_medium": "Email"}, channelEmail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params *map[string]interface{}
+
+			if tt.params != nil {
+				params = &tt.params
+			}
+
+			if got := classifyChannel(tt.host, params); got != tt.want {
+				t.Errorf("classifyChannel(%q) = %s, want %s", tt.host, got, tt.want)
+			}
+		})
+	}
+}
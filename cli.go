@@ -0,0 +1,417 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage: trackma [command]
+
+Without a command the server is started.
+
+commands:
+  sites list                        list registered sites and their aliases
+  sites add <domain> [timezone]     register a site
+  sites remove <domain>             remove a site, its aliases and api keys
+  sites timezone <domain> <tz>      set the timezone of a site
+  sites alias <domain> <alias>      add an alias that is stored as the site
+  sites unalias <alias>             remove an alias
+  sites internal-traffic <domain> <drop|tag>
+                                    drop internal traffic or store it tagged as internal
+  sites visitor-id <domain> <daily_salt|stable>
+                                    hash visitor ids with a daily rotating salt or use the stable unsalted hash,
+                                    with a daily salt visitors are counted once per day they visit
+  sites ip-policy <domain> <full|truncate|drop>
+                                    store full client ips, only their /24 or /48 prefix or no ip at all
+  sites privacy-signals <domain> <drop|anonymize|ignore>
+                                    drop, store without identifiers or ignore events with dnt, gpc or denied consent
+  sites schema-mode <domain> <reject|quarantine|flag>
+                                    reject, quarantine or flag events whose event data doesn't match their schema
+  sites retention <domain> <traffic|events> <days|default>
+                                    keep rows for a number of days, 0 keeps them forever
+  exclusions list <domain>          list the internal traffic rules of a site
+  exclusions add <domain> <cidr|ip|user_agent> <value>
+                                    mark traffic from a range, an ip or a user agent substring as internal
+  exclusions remove <domain> <id>   remove an internal traffic rule
+  paths list <domain>               list the path rules and options of a site
+  paths add <domain> <pattern> <template>
+                                    rewrite paths matching a regular expression, e.g. '^/product/\d+$' '/product/:id'
+  paths remove <domain> <id>        remove a path rule
+  paths option <domain> <strip-index|strip-trailing-slash|lowercase> <on|off>
+                                    set how paths are normalized before the rules are applied
+  paths apply <domain>              re-apply the path rules to stored rows
+  schemas list <domain>             list the event schemas of a site
+  schemas set <domain> <event> <file>
+                                    validate the event data of an event against the json schema in file
+  schemas remove <domain> <event>   remove the schema of an event
+  keys list <domain>                list the api keys of a site
+  keys create <domain>              create an api key for a site
+  keys rotate <domain>              create a new api key and expire the old ones after KEY_ROTATION_GRACE
+  keys revoke <key id>              revoke an api key immediately
+  subjects export [--domain d] [--ip ip] [--user-agent ua] [--visitor-id id]
+                                    print every stored row of a data subject as json, an ip or visitor id is required
+  subjects erase [--domain d] [--ip ip] [--user-agent ua] [--visitor-id id]
+                                    delete every stored row of a data subject, an ip or visitor id is required
+  purge [--dry-run]                 delete rows older than the retention of their site
+  backfill-user-agents              parse the user agents of rows stored before they were parsed at ingest
+  backfill-query-params             store every query parameter of rows stored before multi-valued parameters as a list
+`
+
+// runCommand runs an admin command and returns the process exit code
+func runCommand(db *sql.DB, args []string) int {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return 2
+	}
+
+	err := registry.reload(db)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "sites":
+		err = runSitesCommand(db, args[1:])
+	case "keys":
+		err = runKeysCommand(db, args[1:])
+	case "exclusions":
+		err = runExclusionsCommand(db, args[1:])
+	case "paths":
+		err = runPathsCommand(db, args[1:])
+	case "schemas":
+		err = runSchemasCommand(db, args[1:])
+	case "subjects":
+		err = runSubjectsCommand(db, args[1:])
+	case "purge":
+		dryRun := len(args) > 1 && args[1] == "--dry-run"
+		var purged int64
+		purged, err = purgeExpired(db, dryRun)
+
+		if dryRun {
+			fmt.Printf("would purge %d rows\n", purged)
+		} else {
+			fmt.Printf("purged %d rows\n", purged)
+		}
+	case "backfill-user-agents":
+		var updated int64
+		updated, err = backfillUserAgents(db)
+		fmt.Printf("updated %d rows\n", updated)
+	case "backfill-query-params":
+		var updated int64
+		updated, err = backfillQueryParams(db)
+		fmt.Printf("updated %d rows\n", updated)
+	default:
+		fmt.Print(usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func runKeysCommand(db *sql.DB, args []string) error {
+	if len(args) != 2 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "list":
+		keys, err := listApiKeys(db, normalizeDomain(args[1]))
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			revoked := "active"
+
+			if k.Revoked != nil {
+				revoked = "revoked " + k.Revoked.Format("2006-01-02 15:04:05")
+			}
+
+			fmt.Printf("%s\t%s\tcreated %s\t%s\n", k.Id, k.Domain, k.Created.Format("2006-01-02 15:04:05"), revoked)
+		}
+	case "create", "rotate":
+		var k *apiKey
+		var err error
+
+		if args[0] == "create" {
+			k, err = createApiKey(db, normalizeDomain(args[1]))
+		} else {
+			k, err = rotateApiKeys(db, normalizeDomain(args[1]))
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("key id: %s\ntoken:  %s\n", k.Id, k.Token())
+	case "revoke":
+		err := revokeApiKey(db, args[1])
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("revoked %s\n", args[1])
+	default:
+		return errors.New(usage)
+	}
+
+	return nil
+}
+
+func runSitesCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		for _, s := range registry.list() {
+			fmt.Printf("%s\t%s\t%s\n", s.Domain, s.Timezone, strings.Join(s.Aliases, ","))
+		}
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+		settings := make([]siteSetting, 0)
+
+		if len(args) == 3 {
+			settings = append(settings, timezoneSetting(args[2]))
+		}
+
+		return createSite(db, normalizeDomain(args[1]), nil, settings...)
+	case args[0] == "remove" && len(args) == 2:
+		return deleteSite(db, normalizeDomain(args[1]))
+	case args[0] == "timezone" && len(args) == 3:
+		return setSite(db, normalizeDomain(args[1]), timezoneSetting(args[2]))
+	case args[0] == "alias" && len(args) == 3:
+		return addSiteAlias(db, normalizeDomain(args[1]), normalizeDomain(args[2]))
+	case args[0] == "unalias" && len(args) == 2:
+		return removeSiteAlias(db, normalizeDomain(args[1]))
+	case args[0] == "internal-traffic" && len(args) == 3:
+		return setSite(db, normalizeDomain(args[1]), internalTrafficSetting(args[2]))
+	case args[0] == "visitor-id" && len(args) == 3:
+		return setSite(db, normalizeDomain(args[1]), visitorIdModeSetting(args[2]))
+	case args[0] == "ip-policy" && len(args) == 3:
+		return setSite(db, normalizeDomain(args[1]), ipPolicySetting(args[2]))
+	case args[0] == "privacy-signals" && len(args) == 3:
+		return setSite(db, normalizeDomain(args[1]), privacySignalsSetting(args[2]))
+	case args[0] == "schema-mode" && len(args) == 3:
+		return setSite(db, normalizeDomain(args[1]), schemaModeSetting(args[2]))
+	case args[0] == "retention" && len(args) == 4:
+		if args[3] == "default" {
+			return setSite(db, normalizeDomain(args[1]), retentionSetting(args[2], nil))
+		}
+
+		days, err := strconv.Atoi(args[3])
+
+		if err != nil {
+			return errors.New(usage)
+		}
+
+		return setSite(db, normalizeDomain(args[1]), retentionSetting(args[2], &days))
+	default:
+		return errors.New(usage)
+	}
+
+	return nil
+}
+
+func runExclusionsCommand(db *sql.DB, args []string) error {
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+
+	s, ok := registry.resolve(args[1])
+
+	if !ok {
+		return fmt.Errorf("no site %s", args[1])
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		for _, r := range s.Exclusions {
+			fmt.Printf("%d\t%s\t%s\n", r.Id, r.Kind, r.Value)
+		}
+	case args[0] == "add" && len(args) == 4:
+		r, err := addExclusionRule(db, s.Domain, args[2], args[3])
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("added rule %d\n", r.Id)
+	case args[0] == "remove" && len(args) == 3:
+		id, err := strconv.Atoi(args[2])
+
+		if err != nil {
+			return fmt.Errorf("invalid rule id %s", args[2])
+		}
+
+		return removeExclusionRule(db, s.Domain, id)
+	default:
+		return errors.New(usage)
+	}
+
+	return nil
+}
+
+func runPathsCommand(db *sql.DB, args []string) error {
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+
+	s, ok := registry.resolve(normalizeDomain(args[1]))
+
+	if !ok {
+		return fmt.Errorf("no site %s", args[1])
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		fmt.Printf("strip-index %t, strip-trailing-slash %t, lowercase %t\n", s.PathOptions.StripIndex, s.PathOptions.StripTrailingSlash, s.PathOptions.LowercasePaths)
+
+		for _, r := range s.PathRules {
+			fmt.Printf("%d\t%s\t%s\n", r.Id, r.Pattern, r.Template)
+		}
+	case args[0] == "add" && len(args) == 4:
+		r, err := addPathRule(db, s.Domain, args[2], args[3])
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("added path rule %d\n", r.Id)
+	case args[0] == "remove" && len(args) == 3:
+		id, err := strconv.Atoi(args[2])
+
+		if err != nil {
+			return errors.New(usage)
+		}
+
+		return removePathRule(db, s.Domain, id)
+	case args[0] == "option" && len(args) == 4:
+		if args[3] != "on" && args[3] != "off" {
+			return errors.New(usage)
+		}
+
+		options := s.PathOptions
+		enabled := args[3] == "on"
+
+		switch args[2] {
+		case "strip-index":
+			options.StripIndex = enabled
+		case "strip-trailing-slash":
+			options.StripTrailingSlash = enabled
+		case "lowercase":
+			options.LowercasePaths = enabled
+		default:
+			return errors.New(usage)
+		}
+
+		return setSite(db, s.Domain, pathOptionsSettings(options)...)
+	case args[0] == "apply" && len(args) == 2:
+		updated, err := renormalizePaths(db, s)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("updated %d rows\n", updated)
+	default:
+		return errors.New(usage)
+	}
+
+	return nil
+}
+
+func runSchemasCommand(db *sql.DB, args []string) error {
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+
+	s, ok := registry.resolve(normalizeDomain(args[1]))
+
+	if !ok {
+		return fmt.Errorf("no site %s", args[1])
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		for _, schema := range s.listEventSchemas() {
+			fmt.Printf("%s\t%s\n", schema.EventName, schema.Schema)
+		}
+	case args[0] == "set" && len(args) == 4:
+		schema, err := os.ReadFile(args[3])
+
+		if err != nil {
+			return err
+		}
+
+		return setEventSchema(db, s.Domain, args[2], schema)
+	case args[0] == "remove" && len(args) == 3:
+		return removeEventSchema(db, s.Domain, args[2])
+	default:
+		return errors.New(usage)
+	}
+
+	return nil
+}
+
+func runSubjectsCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	var s subject
+	flags := flag.NewFlagSet("subjects", flag.ContinueOnError)
+	flags.StringVar(&s.Domain, "domain", "", "")
+	flags.StringVar(&s.Ip, "ip", "", "")
+	flags.StringVar(&s.UserAgent, "user-agent", "", "")
+	flags.StringVar(&s.VisitorId, "visitor-id", "", "")
+	flags.SetOutput(io.Discard)
+
+	if flags.Parse(args[1:]) != nil || flags.NArg() > 0 {
+		return errors.New(usage)
+	}
+
+	actor := "cli " + os.Getenv("USER")
+
+	switch args[0] {
+	case "export":
+		data, err := exportSubject(db, actor, s)
+
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(data)
+	case "erase":
+		erasure, err := eraseSubject(db, actor, s)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("deleted %d events and %d traffic rows\n", erasure.Events, erasure.Traffic)
+	default:
+		return errors.New(usage)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"slices"
+	"strings"
+)
+
+// cidrs or single addresses of the proxies in front of trackma and of the servers calling the ingest api
+var TrustedProxies = parseTrustedProxies(envList("TRUSTED_PROXIES"))
+
+// how the client is picked from the ClientIp chain of the ingest api: "first" trusts the first address as sent,
+// "rightmost_untrusted" walks the chain from the right, skipping trusted proxies. Browser facing endpoints
+// always use rightmost_untrusted on the forwarding headers. Unknown modes are treated as first.
+var ClientIpMode = envString("CLIENT_IP_MODE", clientIpFirst)
+
+const (
+	clientIpFirst              = "first"
+	clientIpRightmostUntrusted = "rightmost_untrusted"
+)
+
+func parseTrustedProxies(values []string) []*net.IPNet {
+	result := make([]*net.IPNet, 0, len(values))
+
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(v)
+
+		if err != nil {
+			log.WithFields(log.Fields{"proxy": v}).Warn("Skipping invalid trusted proxy")
+			continue
+		}
+
+		result = append(result, network)
+	}
+
+	return result
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHostIp parses an address that may carry a port or be enclosed in brackets, as in forwarding headers
+func parseHostIp(value string) net.IP {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+
+	return net.ParseIP(strings.Trim(value, "[]"))
+}
+
+// rightmostUntrusted returns the index of the right-most address in chain that isn't a trusted proxy,
+// or 0 if every address is trusted
+func rightmostUntrusted(chain []string) int {
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseHostIp(chain[i])
+
+		if ip == nil || !isTrustedProxy(ip) {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// chainSpoofed reports whether the addresses in front of the right-most untrusted one, which nothing vouches for,
+// are invalid or public. Private addresses there are expected from clients behind their own proxies.
+// Without trusted proxies the chain can't be checked at all.
+func chainSpoofed(chain []string) bool {
+	if len(TrustedProxies) == 0 {
+		return false
+	}
+
+	for _, address := range chain[:rightmostUntrusted(chain)] {
+		ip := parseHostIp(address)
+
+		if ip == nil || !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveClientIp moves the client address picked with mode to the front of the ClientIp chain, keeping the
+// other addresses in order behind it, and flags requests whose chain looks spoofed. Ports and brackets are
+// stripped from every address, entries that aren't addresses are kept as is for validation to reject.
+func resolveClientIp(request *IngestRequest, mode string) {
+	request.IpSpoofed = false
+
+	if len(request.ClientIp) == 0 {
+		return
+	}
+
+	chain := make([]string, len(request.ClientIp))
+
+	for i, address := range request.ClientIp {
+		chain[i] = address
+
+		if ip := parseHostIp(address); ip != nil {
+			chain[i] = ip.String()
+		}
+	}
+
+	request.IpSpoofed = chainSpoofed(chain)
+
+	i := 0
+
+	if mode == clientIpRightmostUntrusted {
+		i = rightmostUntrusted(chain)
+	}
+
+	request.ClientIp = append([]string{chain[i]}, slices.Delete(slices.Clone(chain), i, i+1)...)
+}
+
+// forwardedFor returns the addresses of the Forwarded header, or of X-Forwarded-For if there is none, without ports
+// or brackets. Hops that aren't addresses, such as unknown, the obfuscated identifiers of RFC 7239 or anything else
+// a client made up, hide where the request came from, so they are dropped together with every hop in front of them.
+func forwardedFor(forwarded string, xForwardedFor string) []string {
+	hops := make([]string, 0)
+
+	if forwarded != "" {
+		for _, element := range strings.Split(forwarded, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, value)
+				}
+			}
+		}
+	} else {
+		for _, address := range strings.Split(xForwardedFor, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				hops = append(hops, address)
+			}
+		}
+	}
+
+	result := make([]string, 0, len(hops))
+
+	for _, hop := range hops {
+		ip := parseHostIp(hop)
+
+		if ip == nil {
+			result = result[:0]
+			continue
+		}
+
+		result = append(result, ip.String())
+	}
+
+	return result
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func withTrustedProxies(t *testing.T, proxies ...string) {
+	previous := TrustedProxies
+	TrustedProxies = parseTrustedProxies(proxies)
+	t.Cleanup(func() { TrustedProxies = previous })
+}
+
+func TestResolveClientIp(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		mode    string
+		chain   []string
+		want    []string
+		spoofed bool
+	}{
+		{"first trusts the first address", []string{"10.0.0.0/8"}, clientIpFirst, []string{"6.6.6.6", "1.1.1.1", "10.0.0.1"}, []string{"6.6.6.6", "1.1.1.1", "10.0.0.1"}, true},
+		{"rightmost untrusted skips trusted proxies", []string{"10.0.0.0/8"}, clientIpRightmostUntrusted, []string{"1.1.1.1", "10.0.0.2", "10.0.0.1"}, []string{"1.1.1.1", "10.0.0.2", "10.0.0.1"}, false},
+		{"spoofed first hop loses", []string{"10.0.0.0/8"}, clientIpRightmostUntrusted, []string{"6.6.6.6", "1.1.1.1", "10.0.0.1"}, []string{"1.1.1.1", "6.6.6.6", "10.0.0.1"}, true},
+		{"private addresses in front aren't spoofing", []string{"10.0.0.0/8"}, clientIpRightmostUntrusted, []string{"192.168.1.5", "1.1.1.1", "10.0.0.1"}, []string{"1.1.1.1", "192.168.1.5", "10.0.0.1"}, false},
+		{"invalid addresses in front are spoofing", []string{"10.0.0.0/8"}, clientIpRightmostUntrusted, []string{"x", "1.1.1.1", "10.0.0.1"}, []string{"1.1.1.1", "x", "10.0.0.1"}, true},
+		{"all trusted picks the first", []string{"10.0.0.0/8"}, clientIpRightmostUntrusted, []string{"10.0.0.5", "10.0.0.1"}, []string{"10.0.0.5", "10.0.0.1"}, false},
+		{"single trusted address", []string{"10.0.0.1"}, clientIpRightmostUntrusted, []string{"10.0.0.2", "10.0.0.1"}, []string{"10.0.0.2", "10.0.0.1"}, false},
+		{"without trusted proxies the last address is untrusted", nil, clientIpRightmostUntrusted, []string{"6.6.6.6", "1.1.1.1"}, []string{"1.1.1.1", "6.6.6.6"}, false},
+		{"ports are stripped", []string{"10.0.0.0/8"}, clientIpRightmostUntrusted, []string{"1.1.1.1:4711", "10.0.0.1:80"}, []string{"1.1.1.1", "10.0.0.1"}, false},
+		{"ipv6 brackets are stripped", []string{"2001:db8::/32"}, clientIpRightmostUntrusted, []string{"[2a00::1]:443", "[2001:db8::1]"}, []string{"2a00::1", "2001:db8::1"}, false},
+		{"unknown is kept for validation", []string{"10.0.0.0/8"}, clientIpRightmostUntrusted, []string{"unknown", "10.0.0.1"}, []string{"unknown", "10.0.0.1"}, false},
+		{"unknown mode is first", []string{"10.0.0.0/8"}, "bogus", []string{"1.1.1.1", "10.0.0.1"}, []string{"1.1.1.1", "10.0.0.1"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTrustedProxies(t, tt.trusted...)
+
+			request := IngestRequest{ClientIp: tt.chain, IpSpoofed: !tt.spoofed}
+			resolveClientIp(&request, tt.mode)
+
+			if !slices.Equal(request.ClientIp, tt.want) {
+				t.Errorf("ClientIp = %v, want %v", request.ClientIp, tt.want)
+			}
+
+			if request.IpSpoofed != tt.spoofed {
+				t.Errorf("IpSpoofed = %v, want %v", request.IpSpoofed, tt.spoofed)
+			}
+		})
+	}
+}
+
+func TestResolveClientIpEmpty(t *testing.T) {
+	request := IngestRequest{IpSpoofed: true}
+	resolveClientIp(&request, clientIpRightmostUntrusted)
+
+	if len(request.ClientIp) != 0 || request.IpSpoofed {
+		t.Errorf("got %v spoofed %v, want an empty chain that isn't spoofed", request.ClientIp, request.IpSpoofed)
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	tests := []struct {
+		name          string
+		forwarded     string
+		xForwardedFor string
+		want          []string
+	}{
+		{"no headers", "", "", []string{}},
+		{"x-forwarded-for", "", "1.1.1.1, 10.0.0.1", []string{"1.1.1.1", "10.0.0.1"}},
+		{"empty x-forwarded-for entries", "", "1.1.1.1,, 10.0.0.1,", []string{"1.1.1.1", "10.0.0.1"}},
+		{"x-forwarded-for with ports", "", "1.1.1.1:4711, [2001:db8::1]:80", []string{"1.1.1.1", "2001:db8::1"}},
+		{"junk drops everything in front of it", "", "6.6.6.6, x, 10.0.0.1", []string{"10.0.0.1"}},
+		{"only junk", "", "x", []string{}},
+		{"forwarded", `for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"`, "", []string{"192.0.2.60", "2001:db8:cafe::17"}},
+		{"forwarded keys are case insensitive", "For=192.0.2.60", "", []string{"192.0.2.60"}},
+		{"forwarded unknown", "for=6.6.6.6, for=unknown, for=10.0.0.1", "", []string{"10.0.0.1"}},
+		{"forwarded obfuscated identifier", "for=_hidden, for=198.51.100.17", "", []string{"198.51.100.17"}},
+		{"forwarded wins over x-forwarded-for", "for=192.0.2.60", "6.6.6.6", []string{"192.0.2.60"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := forwardedFor(tt.forwarded, tt.xForwardedFor)
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("forwardedFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::1", "nonsense"})
+
+	if len(networks) != 3 {
+		t.Fatalf("got %d networks, want 3", len(networks))
+	}
+
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::1/128"}
+
+	for i, network := range networks {
+		if network.String() != want[i] {
+			t.Errorf("network %d = %s, want %s", i, network, want[i])
+		}
+	}
+}
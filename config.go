@@ -0,0 +1,107 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envInt reads an integer from the environment, falling back to def when the variable is unset or invalid
+func envInt(name string, def int) int {
+	v, ok := os.LookupEnv(name)
+
+	if !ok || v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+
+	if err != nil {
+		log.WithFields(log.Fields{"variable": name, "value": v}).Warnf("Invalid integer, using default %d", def)
+		return def
+	}
+
+	return i
+}
+
+// envMinInt reads an integer like envInt and exits if it is less than min, a setting that would make the
+// service misbehave is a configuration error rather than something to fall back from
+func envMinInt(name string, def int, min int) int {
+	i := envInt(name, def)
+
+	if i < min {
+		log.WithFields(log.Fields{"variable": name, "value": i}).Fatalf("Invalid setting, must be at least %d", min)
+	}
+
+	return i
+}
+
+// envDuration reads a duration such as "500ms" or "2s" from the environment, falling back to def when the variable is unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+
+	if !ok || v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+
+	if err != nil {
+		log.WithFields(log.Fields{"variable": name, "value": v}).Warnf("Invalid duration, using default %s", def)
+		return def
+	}
+
+	return d
+}
+
+// envPositiveDuration reads a duration like envDuration and exits if it isn't positive
+func envPositiveDuration(name string, def time.Duration) time.Duration {
+	d := envDuration(name, def)
+
+	if d <= 0 {
+		log.WithFields(log.Fields{"variable": name, "value": d}).Fatal("Invalid setting, must be a positive duration")
+	}
+
+	return d
+}
+
+// envString reads a string from the environment, falling back to def when the variable is unset or empty
+func envString(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+
+	return def
+}
+
+// number of events written to the database in a single batch
+var IngestBatchSize = envMinInt("INGEST_BATCH_SIZE", 500, 1)
+
+// max time an event waits in a partial batch before it is written
+var IngestFlushInterval = envPositiveDuration("INGEST_FLUSH_INTERVAL", time.Second)
+
+// number of times a failed batch is retried before it is given up on
+var IngestBatchRetries = envMinInt("INGEST_BATCH_RETRIES", 3, 0)
+
+// number of events that can wait in the pipeline before ingest starts shedding load
+var PipelineCapacity = envMinInt("PIPELINE_CAPACITY", 10000, 1)
+
+// number of workers consuming the pipeline and writing to the database
+var IngestWorkers = envMinInt("INGEST_WORKERS", 1, 1)
+
+// envList reads a comma separated list from the environment, entries are trimmed and lowercased
+func envList(name string) []string {
+	result := make([]string, 0)
+
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
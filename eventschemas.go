@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// what happens to events whose event_data doesn't match the schema of their event name
+const (
+	schemaReject     = "reject"
+	schemaQuarantine = "quarantine"
+	schemaFlag       = "flag"
+)
+
+// max number of quarantined events returned by the admin api
+const quarantineListLimit = 100
+
+var quarantineColumns = []string{"timestamp", "domain", "event_name", "path", "event_data", "error"}
+
+// eventSchema is the json schema the event_data of an event name has to match
+type eventSchema struct {
+	Domain    string          `json:"domain"`
+	EventName string          `json:"event_name"`
+	Schema    json.RawMessage `json:"schema"`
+	Created   time.Time       `json:"created"`
+
+	compiled *jsonSchema
+}
+
+type quarantinedEvent struct {
+	Id        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	EventName string    `json:"event_name"`
+	Path      *string   `json:"path"`
+	EventData *string   `json:"event_data"`
+	Error     string    `json:"error"`
+}
+
+// observedProperty counts the json types a top level event_data property was seen with
+type observedProperty struct {
+	Name     string           `json:"name"`
+	Types    map[string]int64 `json:"types"`
+	InSchema bool             `json:"in_schema"`
+}
+
+type observedEvent struct {
+	EventName  string              `json:"event_name"`
+	Events     int64               `json:"events"`
+	Registered bool                `json:"registered"`
+	Properties []*observedProperty `json:"properties"`
+}
+
+func loadEventSchemas(db *sql.DB) ([]eventSchema, error) {
+	rows, err := db.Query("SELECT domain, event_name, schema, created FROM public.event_schemas ORDER BY domain, event_name")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]eventSchema, 0)
+
+	for rows.Next() {
+		var s eventSchema
+		err := rows.Scan(&s.Domain, &s.EventName, &s.Schema, &s.Created)
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.compiled, err = parseJsonSchema(s.Schema)
+
+		if err != nil {
+			log.WithFields(log.Fields{"domain": s.Domain, "event": s.EventName, "error": err.Error()}).Warn("Skipping invalid event schema")
+			continue
+		}
+
+		result = append(result, s)
+	}
+
+	return result, rows.Err()
+}
+
+// checkEventData validates the event data of a request against the schema of its event name, event data of events
+// with a schema has to be json. Events without event data are checked as an empty object.
+func (s *site) checkEventData(request *IngestRequest) error {
+	schema, ok := s.Schemas[request.EventName]
+
+	if !ok {
+		return nil
+	}
+
+	var data interface{} = map[string]interface{}{}
+
+	if request.EventData != "" {
+		err := json.Unmarshal([]byte(request.EventData), &data)
+
+		if err != nil {
+			return fmt.Errorf("event data is not valid json")
+		}
+	}
+
+	return schema.compiled.validate(data, "")
+}
+
+// schemaViolation returns the schema mode of the site of a request and how its event data violates the schema, if it does
+func schemaViolation(request *IngestRequest) (string, error) {
+	s, ok := registry.resolve(normalizeDomain(request.Domain))
+
+	if !ok {
+		return schemaFlag, nil
+	}
+
+	return s.SchemaMode, s.checkEventData(request)
+}
+
+func quarantineRow(e queuedEvent, violation error) []interface{} {
+	return []interface{}{e.Received, normalizeDomain(e.Request.Domain), e.Request.EventName, emptyStrToNil(e.Request.Path), emptyStrToNil(e.Request.EventData), violation.Error()}
+}
+
+func setEventSchema(db *sql.DB, domain string, eventName string, schema []byte) error {
+	if eventName == "" {
+		return fmt.Errorf("event name is required")
+	}
+
+	_, err := parseJsonSchema(schema)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO public.event_schemas (domain, event_name, schema) VALUES ($1, $2, $3) ON CONFLICT (domain, event_name) DO UPDATE SET schema = excluded.schema",
+		domain, eventName, string(schema))
+
+	if err != nil {
+		return err
+	}
+
+	return registry.reload(db)
+}
+
+func removeEventSchema(db *sql.DB, domain string, eventName string) error {
+	res, err := db.Exec("DELETE FROM public.event_schemas WHERE domain = $1 AND event_name = $2", domain, eventName)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no schema for %s on %s", eventName, domain)
+	}
+
+	return registry.reload(db)
+}
+
+func schemaModeSetting(mode string) siteSetting {
+	if mode != schemaReject && mode != schemaQuarantine && mode != schemaFlag {
+		return siteSetting{err: fmt.Errorf("schema mode must be %s, %s or %s", schemaReject, schemaQuarantine, schemaFlag)}
+	}
+
+	return siteSetting{column: "schema_mode", value: mode}
+}
+
+// listEventSchemas returns the schemas of a site ordered by event name
+func (s *site) listEventSchemas() []*eventSchema {
+	result := make([]*eventSchema, 0, len(s.Schemas))
+
+	for _, schema := range s.Schemas {
+		result = append(result, schema)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].EventName < result[j].EventName
+	})
+
+	return result
+}
+
+func listQuarantinedEvents(db *sql.DB, domain string) ([]quarantinedEvent, error) {
+	rows, err := db.Query("SELECT id, timestamp, event_name, path, event_data, error FROM public.quarantined_events WHERE domain = $1 ORDER BY timestamp DESC LIMIT $2", domain, quarantineListLimit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]quarantinedEvent, 0)
+
+	for rows.Next() {
+		var e quarantinedEvent
+		err := rows.Scan(&e.Id, &e.Timestamp, &e.EventName, &e.Path, &e.EventData, &e.Error)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, e)
+	}
+
+	return result, rows.Err()
+}
+
+// observeEvents lists the event names stored for a site since a point in time and the types their top level
+// event_data properties were seen with, marking which ones aren't covered by a schema
+func (s *site) observeEvents(db *sql.DB, since time.Time) ([]*observedEvent, error) {
+	rows, err := db.Query("SELECT event_name, COUNT(*) FROM public.events WHERE domain = $1 AND timestamp >= $2 GROUP BY event_name ORDER BY event_name", s.Domain, since)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]*observedEvent, 0)
+	events := make(map[string]*observedEvent)
+
+	for rows.Next() {
+		e := observedEvent{Properties: make([]*observedProperty, 0)}
+		err := rows.Scan(&e.EventName, &e.Events)
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, e.Registered = s.Schemas[e.EventName]
+		result = append(result, &e)
+		events[e.EventName] = &e
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT event_name, p.key, jsonb_typeof(p.value), COUNT(*) FROM public.events, "+
+		"jsonb_each(CASE WHEN jsonb_typeof(event_data) = 'object' THEN event_data ELSE '{}'::jsonb END) p "+
+		"WHERE domain = $1 AND timestamp >= $2 GROUP BY 1, 2, 3 ORDER BY 1, 2, 3", s.Domain, since)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var eventName, name, jsonType string
+		var count int64
+		err := rows.Scan(&eventName, &name, &jsonType, &count)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e, ok := events[eventName]
+
+		if !ok {
+			continue
+		}
+
+		// rows are ordered by property, so all types of a property are added to the last one
+		var p *observedProperty
+
+		if n := len(e.Properties); n > 0 && e.Properties[n-1].Name == name {
+			p = e.Properties[n-1]
+		} else {
+			p = &observedProperty{Name: name, Types: make(map[string]int64)}
+
+			if schema, ok := s.Schemas[eventName]; ok {
+				_, p.InSchema = schema.compiled.Properties[name]
+			}
+
+			e.Properties = append(e.Properties, p)
+		}
+
+		p.Types[jsonType] = count
+	}
+
+	return result, rows.Err()
+}
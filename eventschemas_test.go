@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestCheckEventData(t *testing.T) {
+	compiled, err := parseJsonSchema([]byte(`{"type": "object", "required": ["plan"]}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &site{Domain: "example.com", Schemas: map[string]*eventSchema{"signup": {EventName: "signup", compiled: compiled}}}
+
+	tests := []struct {
+		name      string
+		eventName string
+		eventData string
+		err       string
+	}{
+		{"no schema and no json", "click", "free form text", ""},
+		{"no schema and no event data", "click", "", ""},
+		{"valid", "signup", `{"plan": "pro"}`, ""},
+		{"not json", "signup", "plan=pro", "event data is not valid json"},
+		{"no event data is an empty object", "signup", "", "/plan is required"},
+		{"violation", "signup", `{"seats": 1}`, "/plan is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.checkEventData(&IngestRequest{Domain: "example.com", EventName: tt.eventName, EventData: tt.eventData})
+
+			if tt.err == "" && err != nil {
+				t.Fatalf("checkEventData() error = %v, want none", err)
+			}
+
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Fatalf("checkEventData() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// kinds of exclusion rules
+const (
+	exclusionCidr      = "cidr"
+	exclusionIp        = "ip"
+	exclusionUserAgent = "user_agent"
+)
+
+// what happens to events matching an exclusion rule
+const (
+	internalTrafficDrop = "drop"
+	internalTrafficTag  = "tag"
+)
+
+// exclusionRule marks traffic from an ip range, a single ip or a user agent containing a substring as internal
+type exclusionRule struct {
+	Id     int    `json:"id"`
+	Domain string `json:"domain"`
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+
+	network *net.IPNet
+	ip      net.IP
+}
+
+// compile validates the rule and parses its value
+func (r *exclusionRule) compile() error {
+	switch r.Kind {
+	case exclusionCidr:
+		_, network, err := net.ParseCIDR(r.Value)
+
+		if err != nil {
+			return fmt.Errorf("invalid cidr %s", r.Value)
+		}
+
+		r.network = network
+	case exclusionIp:
+		r.ip = net.ParseIP(r.Value)
+
+		if r.ip == nil {
+			return fmt.Errorf("invalid ip %s", r.Value)
+		}
+	case exclusionUserAgent:
+		if r.Value == "" {
+			return fmt.Errorf("user agent can't be empty")
+		}
+	default:
+		return fmt.Errorf("unknown exclusion kind %s, must be one of %s, %s or %s", r.Kind, exclusionCidr, exclusionIp, exclusionUserAgent)
+	}
+
+	return nil
+}
+
+func (r *exclusionRule) matchesIp(ip net.IP) bool {
+	switch r.Kind {
+	case exclusionCidr:
+		return r.network.Contains(ip)
+	case exclusionIp:
+		return r.ip.Equal(ip)
+	}
+
+	return false
+}
+
+// isInternal checks the user agent and every address in the client ip chain against the exclusion rules of the site
+func (s *site) isInternal(clientIps []string, userAgent string) bool {
+	if len(s.Exclusions) == 0 {
+		return false
+	}
+
+	ua := strings.ToLower(userAgent)
+
+	for _, r := range s.Exclusions {
+		if r.Kind == exclusionUserAgent && strings.Contains(ua, strings.ToLower(r.Value)) {
+			return true
+		}
+	}
+
+	for _, clientIp := range clientIps {
+		ip := net.ParseIP(strings.TrimSpace(clientIp))
+
+		if ip == nil {
+			continue
+		}
+
+		for _, r := range s.Exclusions {
+			if r.matchesIp(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func loadExclusionRules(db *sql.DB) ([]exclusionRule, error) {
+	rows, err := db.Query("SELECT id, domain, kind, value FROM public.exclusion_rules ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]exclusionRule, 0)
+
+	for rows.Next() {
+		var r exclusionRule
+		err := rows.Scan(&r.Id, &r.Domain, &r.Kind, &r.Value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if r.compile() != nil {
+			continue
+		}
+
+		result = append(result, r)
+	}
+
+	return result, rows.Err()
+}
+
+func addExclusionRule(db *sql.DB, domain string, kind string, value string) (*exclusionRule, error) {
+	r := exclusionRule{Domain: domain, Kind: kind, Value: strings.TrimSpace(value)}
+	err := r.compile()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.QueryRow("INSERT INTO public.exclusion_rules (domain, kind, value) VALUES ($1, $2, $3) RETURNING id", r.Domain, r.Kind, r.Value).Scan(&r.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, registry.reload(db)
+}
+
+func removeExclusionRule(db *sql.DB, domain string, id int) error {
+	res, err := db.Exec("DELETE FROM public.exclusion_rules WHERE id = $1 AND domain = $2", id, domain)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no exclusion rule %d for %s", id, domain)
+	}
+
+	return registry.reload(db)
+}
+
+func internalTrafficSetting(mode string) siteSetting {
+	if mode != internalTrafficDrop && mode != internalTrafficTag {
+		return siteSetting{err: fmt.Errorf("internal traffic must be %s or %s", internalTrafficDrop, internalTrafficTag)}
+	}
+
+	return siteSetting{column: "internal_traffic", value: mode}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// max time a readiness check waits for each database
+var ReadyzTimeout = envDuration("READYZ_TIMEOUT", 2*time.Second)
+
+// pipeline fill level, in percent of its capacity, from which the instance reports it isn't ready
+var ReadyzPipelinePercent = envInt("READYZ_PIPELINE_PERCENT", 90)
+
+// time to wait before retrying a startup step that failed
+var StartupRetryInterval = envDuration("STARTUP_RETRY_INTERVAL", 5*time.Second)
+
+// set once startup has migrated the database, loaded the sites and the ip2country database and started the writers
+var started atomic.Bool
+
+// the startup step that is running or failed last, reported by readiness checks until startup is done
+var startupMu sync.Mutex
+var startupStep string
+var startupError error
+
+type healthCheck struct {
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// retryStartup runs a startup step until it succeeds
+func retryStartup(step string, run func() error) {
+	for {
+		startupMu.Lock()
+		startupStep = step
+		startupMu.Unlock()
+
+		err := run()
+
+		startupMu.Lock()
+		startupError = err
+		startupMu.Unlock()
+
+		if err == nil {
+			return
+		}
+
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "step": step, "retry": StartupRetryInterval}).Error("Startup step failed")
+		time.Sleep(StartupRetryInterval)
+	}
+}
+
+// startup migrates the database, loads the sites and the ip2country database and then starts the writers. It runs
+// in the background so the server can answer health checks meanwhile, ingest endpoints are unavailable until it is done.
+func startup(d *sql.DB, writeDb *sql.DB) {
+	retryStartup("migrate database", func() error {
+		return MigrateDb(d)
+	})
+
+	retryStartup("load sites", func() error {
+		return registry.reload(d)
+	})
+
+	go registry.refresh(d)
+	go anonymizeIpsPeriodically(d)
+	go purgePeriodically(d)
+
+	retryStartup("load ip2country database", func() error {
+		return LoadIp2CountryDb(filepath.Join(Root, "dbip-country-lite.csv"))
+	})
+
+	startWorkers(writeDb, IngestWorkers)
+
+	started.Store(true)
+	log.Info("Started")
+}
+
+// rejectUntilStarted is a middleware for ingest endpoints that turns away events until startup is done
+func rejectUntilStarted(ctx iris.Context) {
+	if !started.Load() {
+		metricRejected.inc(rejectStarting)
+		ctx.Header("Retry-After", strconv.Itoa(IngestRetryAfter))
+		ctx.StopWithStatus(iris.StatusServiceUnavailable)
+		return
+	}
+
+	ctx.Next()
+}
+
+func checkDatabase(d *sql.DB) healthCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), ReadyzTimeout)
+	defer cancel()
+
+	err := d.PingContext(ctx)
+
+	if err != nil {
+		return healthCheck{Error: err.Error()}
+	}
+
+	return healthCheck{Ok: true}
+}
+
+func checkMigrations(d *sql.DB) healthCheck {
+	current, err := getCurrentMigratedVersion(d)
+
+	if err != nil {
+		return healthCheck{Error: err.Error()}
+	}
+
+	latest, err := latestMigrationVersion()
+
+	if err != nil {
+		return healthCheck{Error: err.Error()}
+	}
+
+	check := healthCheck{Ok: current >= latest, Detail: fmt.Sprintf("version %d of %d", current, latest)}
+
+	if !check.Ok {
+		check.Error = "database isn't migrated"
+	}
+
+	return check
+}
+
+func checkIp2Country() healthCheck {
+	if !Ip2CountryDbLoaded() {
+		return healthCheck{Error: "ip2country database isn't loaded"}
+	}
+
+	return healthCheck{Ok: true}
+}
+
+func checkPipeline() healthCheck {
+	depth := len(pipeline)
+	capacity := cap(pipeline)
+	check := healthCheck{Ok: depth*100 < capacity*ReadyzPipelinePercent, Detail: fmt.Sprintf("%d of %d", depth, capacity)}
+
+	if !check.Ok {
+		check.Error = "pipeline is saturated"
+	}
+
+	return check
+}
+
+func checkStartup() healthCheck {
+	if started.Load() {
+		return healthCheck{Ok: true}
+	}
+
+	startupMu.Lock()
+	defer startupMu.Unlock()
+
+	check := healthCheck{Detail: startupStep}
+
+	if startupError != nil {
+		check.Error = startupError.Error()
+	} else {
+		check.Error = "starting"
+	}
+
+	return check
+}
+
+func getReadiness(readDb *sql.DB, writeDb *sql.DB) readiness {
+	r := readiness{
+		Checks: map[string]healthCheck{
+			"database":       checkDatabase(readDb),
+			"write_database": checkDatabase(writeDb),
+			"migrations":     checkMigrations(readDb),
+			"ip2country":     checkIp2Country(),
+			"pipeline":       checkPipeline(),
+			"startup":        checkStartup(),
+		},
+	}
+
+	if shuttingDown.Load() {
+		r.Checks["shutdown"] = healthCheck{Error: "shutting down"}
+	}
+
+	r.Ready = true
+
+	for _, check := range r.Checks {
+		r.Ready = r.Ready && check.Ok
+	}
+
+	return r
+}
+
+// registerHealthRoutes adds /healthz, which only tells whether the process is serving requests,
+// and /readyz, which checks everything the instance needs to ingest events and answers 503 if anything fails
+func registerHealthRoutes(app *iris.Application, readDb *sql.DB, writeDb *sql.DB) {
+	app.Get("/healthz", func(ctx iris.Context) {
+		_ = ctx.JSON(iris.Map{"ok": true})
+	})
+
+	app.Get("/readyz", func(ctx iris.Context) {
+		r := getReadiness(readDb, writeDb)
+
+		if !r.Ready {
+			ctx.StatusCode(iris.StatusServiceUnavailable)
+		}
+
+		_ = ctx.JSON(r)
+	})
+}
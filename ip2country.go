@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // ErrInvalidLine when csv line is invalid
@@ -24,17 +25,31 @@ type ipRange struct {
 }
 
 var arr []ipRange
-var once sync.Once
-var loadError error
+var loadMu sync.Mutex
+var loaded atomic.Bool
 
 // Load db-ip.com csv file
-// It must be called only once
+// It can be called again if it failed, once it succeeded further calls do nothing
 func LoadIp2CountryDb(filepath string) error {
-	once.Do(func() {
-		loadError = load(filepath)
-	})
+	loadMu.Lock()
+	defer loadMu.Unlock()
 
-	return loadError
+	if loaded.Load() {
+		return nil
+	}
+
+	err := load(filepath)
+
+	if err == nil {
+		loaded.Store(true)
+	}
+
+	return err
+}
+
+// Ip2CountryDbLoaded reports whether LoadIp2CountryDb succeeded
+func Ip2CountryDbLoaded() bool {
+	return loaded.Load()
 }
 
 // GetCountry returns the country which ip belongs to
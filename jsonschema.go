@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// jsonSchema is the subset of json schema used to describe event_data: type, enum, const, required, properties,
+// additionalProperties, items, minimum, maximum, minLength, maxLength, pattern, minItems and maxItems.
+// Schemas using other keywords, such as $ref, oneOf or format, are rejected rather than half enforced.
+type jsonSchema struct {
+	Types                []string
+	Enum                 []interface{}
+	Const                interface{}
+	HasConst             bool
+	Required             []string
+	Properties           map[string]*jsonSchema
+	AdditionalProperties *jsonSchema
+	NoAdditional         bool
+	Items                *jsonSchema
+	Minimum              *float64
+	Maximum              *float64
+	MinLength            *int
+	MaxLength            *int
+	Pattern              *regexp.Regexp
+	MinItems             *int
+	MaxItems             *int
+}
+
+var jsonSchemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+var jsonSchemaKeywords = []string{"type", "enum", "const", "required", "properties", "additionalProperties", "items",
+	"minimum", "maximum", "minLength", "maxLength", "pattern", "minItems", "maxItems"}
+
+// keywords that only document a schema and don't change what it matches
+var jsonSchemaAnnotations = []string{"$schema", "$id", "$comment", "title", "description", "default", "examples"}
+
+// parseJsonSchema compiles a schema document
+func parseJsonSchema(document []byte) (*jsonSchema, error) {
+	var raw interface{}
+	err := json.Unmarshal(document, &raw)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+
+	return compileJsonSchema(raw, "")
+}
+
+func schemaNumber(raw map[string]interface{}, key string, path string) (*float64, error) {
+	v, ok := raw[key]
+
+	if !ok {
+		return nil, nil
+	}
+
+	f, ok := v.(float64)
+
+	if !ok {
+		return nil, fmt.Errorf("invalid schema at %s: %s must be a number", schemaPath(path), key)
+	}
+
+	return &f, nil
+}
+
+func schemaInt(raw map[string]interface{}, key string, path string) (*int, error) {
+	f, err := schemaNumber(raw, key, path)
+
+	if err != nil || f == nil {
+		return nil, err
+	}
+
+	if *f < 0 || *f != math.Trunc(*f) {
+		return nil, fmt.Errorf("invalid schema at %s: %s must be a non-negative integer", schemaPath(path), key)
+	}
+
+	i := int(*f)
+
+	return &i, nil
+}
+
+func schemaPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	return path
+}
+
+func compileJsonSchema(raw interface{}, path string) (*jsonSchema, error) {
+	// true and false are valid schemas matching anything and nothing
+	if b, ok := raw.(bool); ok {
+		if b {
+			return &jsonSchema{}, nil
+		}
+
+		return &jsonSchema{Types: []string{}}, nil
+	}
+
+	m, ok := raw.(map[string]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("invalid schema at %s: must be an object", schemaPath(path))
+	}
+
+	keywords := make([]string, 0, len(m))
+
+	for keyword := range m {
+		keywords = append(keywords, keyword)
+	}
+
+	sort.Strings(keywords)
+
+	for _, keyword := range keywords {
+		if !slices.Contains(jsonSchemaKeywords, keyword) && !slices.Contains(jsonSchemaAnnotations, keyword) {
+			return nil, fmt.Errorf("invalid schema at %s: unsupported keyword %s", schemaPath(path), keyword)
+		}
+	}
+
+	s := jsonSchema{}
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.Types = []string{t}
+	case []interface{}:
+		s.Types = make([]string, 0, len(t))
+
+		for _, v := range t {
+			name, ok := v.(string)
+
+			if !ok {
+				return nil, fmt.Errorf("invalid schema at %s: type must be a string or a list of strings", schemaPath(path))
+			}
+
+			s.Types = append(s.Types, name)
+		}
+	default:
+		return nil, fmt.Errorf("invalid schema at %s: type must be a string or a list of strings", schemaPath(path))
+	}
+
+	for _, t := range s.Types {
+		if !slices.Contains(jsonSchemaTypes, t) {
+			return nil, fmt.Errorf("invalid schema at %s: unknown type %s", schemaPath(path), t)
+		}
+	}
+
+	if enum, ok := m["enum"]; ok {
+		values, ok := enum.([]interface{})
+
+		if !ok {
+			return nil, fmt.Errorf("invalid schema at %s: enum must be a list", schemaPath(path))
+		}
+
+		s.Enum = values
+	}
+
+	s.Const, s.HasConst = m["const"]
+
+	if required, ok := m["required"]; ok {
+		names, ok := required.([]interface{})
+
+		if !ok {
+			return nil, fmt.Errorf("invalid schema at %s: required must be a list", schemaPath(path))
+		}
+
+		for _, n := range names {
+			name, ok := n.(string)
+
+			if !ok {
+				return nil, fmt.Errorf("invalid schema at %s: required must be a list of strings", schemaPath(path))
+			}
+
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	if properties, ok := m["properties"]; ok {
+		props, ok := properties.(map[string]interface{})
+
+		if !ok {
+			return nil, fmt.Errorf("invalid schema at %s: properties must be an object", schemaPath(path))
+		}
+
+		s.Properties = make(map[string]*jsonSchema, len(props))
+
+		for name, p := range props {
+			ps, err := compileJsonSchema(p, path+"/"+name)
+
+			if err != nil {
+				return nil, err
+			}
+
+			s.Properties[name] = ps
+		}
+	}
+
+	switch additional := m["additionalProperties"].(type) {
+	case nil:
+	case bool:
+		s.NoAdditional = !additional
+	default:
+		as, err := compileJsonSchema(additional, path+"/additionalProperties")
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.AdditionalProperties = as
+	}
+
+	if items, ok := m["items"]; ok {
+		is, err := compileJsonSchema(items, path+"/items")
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.Items = is
+	}
+
+	var err error
+
+	if s.Minimum, err = schemaNumber(m, "minimum", path); err != nil {
+		return nil, err
+	}
+
+	if s.Maximum, err = schemaNumber(m, "maximum", path); err != nil {
+		return nil, err
+	}
+
+	if s.MinLength, err = schemaInt(m, "minLength", path); err != nil {
+		return nil, err
+	}
+
+	if s.MaxLength, err = schemaInt(m, "maxLength", path); err != nil {
+		return nil, err
+	}
+
+	if s.MinItems, err = schemaInt(m, "minItems", path); err != nil {
+		return nil, err
+	}
+
+	if s.MaxItems, err = schemaInt(m, "maxItems", path); err != nil {
+		return nil, err
+	}
+
+	if pattern, ok := m["pattern"]; ok {
+		p, ok := pattern.(string)
+
+		if !ok {
+			return nil, fmt.Errorf("invalid schema at %s: pattern must be a string", schemaPath(path))
+		}
+
+		s.Pattern, err = regexp.Compile(p)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema at %s: %w", schemaPath(path), err)
+		}
+	}
+
+	return &s, nil
+}
+
+// jsonType returns the json schema type of a value decoded by encoding/json, integers are reported as integer
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	return "unknown"
+}
+
+func (s *jsonSchema) matchesType(value interface{}) bool {
+	if s.Types == nil {
+		return true
+	}
+
+	t := jsonType(value)
+
+	for _, allowed := range s.Types {
+		if allowed == t || (allowed == "number" && t == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func jsonEqual(a interface{}, b interface{}) bool {
+	aj, _ := json.Marshal(a)
+	bj, _ := json.Marshal(b)
+
+	return string(aj) == string(bj)
+}
+
+// validate returns the first violation of the schema by value, value is decoded by encoding/json
+func (s *jsonSchema) validate(value interface{}, path string) error {
+	if !s.matchesType(value) {
+		if len(s.Types) == 0 {
+			return fmt.Errorf("%s is not allowed", schemaPath(path))
+		}
+
+		return fmt.Errorf("%s must be %s", schemaPath(path), strings.Join(s.Types, " or "))
+	}
+
+	if s.Enum != nil && !slices.ContainsFunc(s.Enum, func(e interface{}) bool { return jsonEqual(e, value) }) {
+		return fmt.Errorf("%s must be one of the allowed values", schemaPath(path))
+	}
+
+	if s.HasConst && !jsonEqual(s.Const, value) {
+		return fmt.Errorf("%s must be %v", schemaPath(path), s.Const)
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s must be at least %v", schemaPath(path), *s.Minimum)
+		}
+
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s must be at most %v", schemaPath(path), *s.Maximum)
+		}
+	case string:
+		length := len([]rune(v))
+
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s must be at least %d characters", schemaPath(path), *s.MinLength)
+		}
+
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters", schemaPath(path), *s.MaxLength)
+		}
+
+		if s.Pattern != nil && !s.Pattern.MatchString(v) {
+			return fmt.Errorf("%s must match %s", schemaPath(path), s.Pattern.String())
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s must have at least %d items", schemaPath(path), *s.MinItems)
+		}
+
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s must have at most %d items", schemaPath(path), *s.MaxItems)
+		}
+
+		if s.Items != nil {
+			for i, item := range v {
+				err := s.Items.validate(item, fmt.Sprintf("%s/%d", path, i))
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s/%s is required", path, name)
+			}
+		}
+
+		// sorted so the reported violation is always the same one
+		names := make([]string, 0, len(v))
+
+		for name := range v {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			ps, ok := s.Properties[name]
+
+			if !ok {
+				if s.NoAdditional {
+					return fmt.Errorf("%s/%s is not allowed", path, name)
+				}
+
+				ps = s.AdditionalProperties
+			}
+
+			if ps == nil {
+				continue
+			}
+
+			err := ps.validate(v[name], path+"/"+name)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
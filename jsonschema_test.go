@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseJsonSchemaRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{"not json", `{`, "invalid schema"},
+		{"not an object", `"string"`, "must be an object"},
+		{"unknown type", `{"type": "date"}`, "unknown type date"},
+		{"type of the wrong kind", `{"type": 1}`, "type must be a string or a list of strings"},
+		{"enum isn't a list", `{"enum": "a"}`, "enum must be a list"},
+		{"required isn't a list of strings", `{"required": [1]}`, "required must be a list of strings"},
+		{"properties isn't an object", `{"properties": []}`, "properties must be an object"},
+		{"minimum isn't a number", `{"minimum": "1"}`, "minimum must be a number"},
+		{"negative min length", `{"minLength": -1}`, "minLength must be a non-negative integer"},
+		{"fractional max items", `{"maxItems": 1.5}`, "maxItems must be a non-negative integer"},
+		{"invalid pattern", `{"pattern": "("}`, "invalid schema at /"},
+		{"$ref", `{"$ref": "#/definitions/a"}`, "unsupported keyword $ref"},
+		{"oneOf", `{"oneOf": [{"type": "string"}]}`, "unsupported keyword oneOf"},
+		{"anyOf", `{"anyOf": [{"type": "string"}]}`, "unsupported keyword anyOf"},
+		{"format", `{"type": "string", "format": "email"}`, "unsupported keyword format"},
+		{"exclusiveMinimum", `{"exclusiveMinimum": 0}`, "unsupported keyword exclusiveMinimum"},
+		{"unsupported keyword in a property", `{"properties": {"a": {"format": "uri"}}}`, "invalid schema at /a: unsupported keyword format"},
+		{"unsupported keyword in items", `{"items": {"allOf": []}}`, "invalid schema at /items: unsupported keyword allOf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseJsonSchema([]byte(tt.schema))
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("parseJsonSchema() error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseJsonSchemaAnnotations(t *testing.T) {
+	_, err := parseJsonSchema([]byte(`{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "t", "description": "d", "type": "object"}`))
+
+	if err != nil {
+		t.Fatalf("parseJsonSchema() error = %v", err)
+	}
+}
+
+func TestJsonSchemaValidate(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"required": ["plan"],
+		"properties": {
+			"plan": {"enum": ["free", "pro"]},
+			"seats": {"type": "integer", "minimum": 1, "maximum": 100},
+			"price": {"type": "number"},
+			"code": {"type": "string", "minLength": 2, "maxLength": 4, "pattern": "^[A-Z]+$"},
+			"tags": {"type": "array", "items": {"type": "string"}, "minItems": 1, "maxItems": 2},
+			"version": {"const": 2},
+			"note": {"type": ["string", "null"]}
+		},
+		"additionalProperties": false
+	}`
+
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"valid", `{"plan": "pro", "seats": 3, "price": 9.5, "code": "AB", "tags": ["a"], "version": 2, "note": null}`, ""},
+		{"minimal", `{"plan": "free"}`, ""},
+		{"integers are numbers", `{"plan": "free", "price": 10}`, ""},
+		{"missing required", `{}`, "/plan is required"},
+		{"not in enum", `{"plan": "team"}`, "/plan must be one of the allowed values"},
+		{"wrong type", `{"plan": "free", "seats": "3"}`, "/seats must be integer"},
+		{"fraction isn't an integer", `{"plan": "free", "seats": 1.5}`, "/seats must be integer"},
+		{"below minimum", `{"plan": "free", "seats": 0}`, "/seats must be at least 1"},
+		{"above maximum", `{"plan": "free", "seats": 101}`, "/seats must be at most 100"},
+		{"too short", `{"plan": "free", "code": "A"}`, "/code must be at least 2 characters"},
+		{"too long", `{"plan": "free", "code": "ABCDE"}`, "/code must be at most 4 characters"},
+		{"pattern", `{"plan": "free", "code": "ab"}`, "/code must match ^[A-Z]+$"},
+		{"too few items", `{"plan": "free", "tags": []}`, "/tags must have at least 1 items"},
+		{"too many items", `{"plan": "free", "tags": ["a", "b", "c"]}`, "/tags must have at most 2 items"},
+		{"wrong item type", `{"plan": "free", "tags": [1]}`, "/tags/0 must be string"},
+		{"const", `{"plan": "free", "version": 1}`, "/version must be 2"},
+		{"type list", `{"plan": "free", "note": 1}`, "/note must be string or null"},
+		{"additional property", `{"plan": "free", "extra": 1}`, "/extra is not allowed"},
+		{"not an object", `[]`, "/ must be object"},
+	}
+
+	compiled, err := parseJsonSchema([]byte(schema))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data interface{}
+
+			if err := json.Unmarshal([]byte(tt.data), &data); err != nil {
+				t.Fatal(err)
+			}
+
+			err := compiled.validate(data, "")
+
+			if tt.err == "" && err != nil {
+				t.Fatalf("validate() error = %v, want none", err)
+			}
+
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Fatalf("validate() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestJsonSchemaBooleanSchemas(t *testing.T) {
+	schema, err := parseJsonSchema([]byte(`{"properties": {"any": true, "none": false}, "additionalProperties": {"type": "string"}}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{`{"any": [1, {"a": null}]}`, true},
+		{`{"none": 1}`, false},
+		{`{"other": "text"}`, true},
+		{`{"other": 1}`, false},
+	}
+
+	for _, tt := range tests {
+		var data interface{}
+		_ = json.Unmarshal([]byte(tt.data), &data)
+
+		if err := schema.validate(data, ""); (err == nil) != tt.ok {
+			t.Errorf("validate(%s) error = %v, want ok %v", tt.data, err, tt.ok)
+		}
+	}
+}
@@ -1,19 +1,14 @@
 package main
 
 import (
-	"crypto/sha256"
 	"database/sql"
-	"database/sql/driver"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/kataras/iris/v12"
-	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
-	"net/url"
+	"net"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 )
@@ -30,9 +25,12 @@ type IngestRequest struct {
 	Duration        int64    `json:"duration"`
 	StatusCode      int16    `json:"statusCode"`
 	EventData       string   `json:"eventData"`
+	Dnt             bool     `json:"dnt"`
+	Gpc             bool     `json:"gpc"`
+	Consent         string   `json:"consent"`
+	IpSpoofed       bool     `json:"ipSpoofed"`
 }
 
-var pipeline = make(chan IngestRequest, 10000)
 var ConnStr = os.Getenv("CONNSTR")
 var db *sql.DB
 
@@ -43,6 +41,11 @@ func emptyStrToNil(s string) *string {
 	return &s
 }
 
+// normalizeDomain is the form domains are stored in
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSpace(domain))
+}
+
 func intToNil(i int64) *int64 {
 	if i == 0 {
 		return nil
@@ -51,91 +54,65 @@ func intToNil(i int64) *int64 {
 	return &i
 }
 
-func handleRequests() {
+// queryKeys splits the comma separated query parameter names of a stats request
+func queryKeys(param string) []string {
+	keys := make([]string, 0)
 
-	writeDb, err := sql.Open("postgres", ConnStr)
-	if err != nil {
-		log.Fatal(err)
+	for _, key := range strings.Split(param, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
 	}
 
-	defer writeDb.Close()
+	return keys
+}
 
-	err = LoadIp2CountryDb(filepath.Join(Root, "dbip-country-lite.csv"))
+var errInvalidEventData = errors.New("invalid event data")
 
-	if err != nil {
-		log.Fatal(err)
+func validateIngestRequest(request *IngestRequest) error {
+	if len(request.ClientIp) == 0 {
+		return fmt.Errorf("client ip is required")
 	}
 
-	for {
-		request := <-pipeline
-
-		values, err := url.ParseQuery(request.Query)
-
-		if err != nil {
-			log.Error(err)
-			continue
+	for _, ip := range request.ClientIp {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid client ip %s", ip)
 		}
+	}
 
-		qv := make(map[string]string)
-		var queryJson *[]byte
-
-		if len(values) > 0 {
-			for key := range values {
-				qv[key] = values.Get(key)
-			}
-
-			qj, err := json.Marshal(qv)
+	if request.Domain == "" {
+		return fmt.Errorf("domain is required")
+	}
 
-			if err != nil {
-				log.Errorf("Failed to serialize json: %s", err)
-				continue
-			}
+	if request.EventName == "page_view" && request.Path == "" {
+		return fmt.Errorf("path is required")
+	}
 
-			queryJson = &qj
-		}
+	if request.EventName == "" {
+		return fmt.Errorf("event name is required")
+	}
 
-		var edJson *[]byte
+	if request.Consent != "" && request.Consent != consentGranted && request.Consent != consentDenied {
+		return fmt.Errorf("consent must be %s or %s", consentGranted, consentDenied)
+	}
 
-		if len(request.EventData) > 0 {
-			bytes := []byte(request.EventData)
-			if json.Valid(bytes) {
-				edJson = &bytes
-			}
-		}
+	s, ok := registry.resolve(request.Domain)
 
-		country := GetCountry(request.ClientIp[0])
+	if !ok {
+		return fmt.Errorf("domain %s is not registered", request.Domain)
+	}
 
-		h := sha256.New()
-		h.Write([]byte(request.ClientIp[0] + request.ClientUserAgent))
-		visitorId := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	request.Domain = s.Domain
 
-		// insert to events
-		_, err = writeDb.Exec("insert into public.events (\"timestamp\", \"domain\", event_name, duration, user_agent, referrer, path, visitor_id, session_id, query_params, country, status_code, event_data) values (NOW(), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);",
-			strings.ToLower(strings.TrimSpace(request.Domain)), request.EventName, intToNil(request.Duration), request.ClientUserAgent, emptyStrToNil(request.Referrer), request.Path, visitorId, emptyStrToNil(request.SessionId), queryJson, country, request.StatusCode, edJson)
+	if s.SchemaMode == schemaReject {
+		err := s.checkEventData(request)
 
 		if err != nil {
-			log.Errorf("Failed to insert event row: %s", err)
-		}
-
-		// insert into monthly traffic
-		if request.EventName == "page_view" {
-			var ips *interface {
-				driver.Valuer
-				sql.Scanner
-			} = nil
-
-			if len(request.ClientIp) > 1 {
-				var x = pq.Array(request.ClientIp[1:])
-				ips = &x
-			}
-			_, err = writeDb.Exec("insert into public.monthly_traffic (timestamp, domain, duration, user_agent, referrer, path, query_params, country, status_code, ip, ips) values (NOW(), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
-				strings.ToLower(strings.TrimSpace(request.Domain)), intToNil(request.Duration), request.ClientUserAgent, emptyStrToNil(request.Referrer), request.Path, queryJson, country, request.StatusCode, request.ClientIp[0], ips)
-
-			if err != nil {
-				log.Errorf("Failed to insert traffic row: %s", err)
-			}
+			return fmt.Errorf("%w for %s: %w", errInvalidEventData, request.EventName, err)
 		}
 	}
+
+	return nil
 }
 
 func handleIngest(ctx iris.Context) {
@@ -152,28 +129,28 @@ func handleIngest(ctx iris.Context) {
 		return
 	}
 
-	if len(ingestBody.ClientIp) == 0 {
-		ctx.StopWithError(iris.StatusBadRequest, fmt.Errorf("client ip is required"))
-		return
-	}
+	resolveClientIp(&ingestBody, ClientIpMode)
+	err = validateIngestRequest(&ingestBody)
 
-	if ingestBody.Domain == "" {
-		ctx.StopWithError(iris.StatusBadRequest, fmt.Errorf("domain is required"))
+	if err != nil {
+		rejectEvent(validationRejectReason(err))
+		ctx.StopWithError(iris.StatusBadRequest, err)
 		return
 	}
 
-	if ingestBody.EventName == "page_view" && ingestBody.Path == "" {
-		ctx.StopWithError(iris.StatusBadRequest, fmt.Errorf("path is required"))
+	err = authorizeDomain(ctx, ingestBody.Domain)
+
+	if err != nil {
+		rejectEvent(rejectUnauthorized)
+		ctx.StopWithError(iris.StatusForbidden, err)
 		return
 	}
 
-	if ingestBody.EventName == "" {
-		ctx.StopWithError(iris.StatusBadRequest, fmt.Errorf("event name is required"))
+	if !enqueue(ingestBody) {
+		stopPipelineFull(ctx)
 		return
 	}
 
-	pipeline <- ingestBody
-
 	ctx.StatusCode(iris.StatusOK)
 }
 
@@ -221,9 +198,23 @@ func handleStatsRequest(ctx iris.Context) {
 		}
 	}
 
-	stats, err := GetStats(db, "kilohearts.com", start, end)
+	domain := ctx.URLParamDefault("domain", "kilohearts.com")
+
+	if s, ok := registry.resolve(domain); ok {
+		domain = s.Domain
+	}
+
+	options := StatsOptions{
+		BotBreakdown:   ctx.URLParamBoolDefault("bots", false),
+		QueryBreakdown: queryKeys(ctx.URLParam("query")),
+	}
+
+	started := time.Now()
+	stats, err := GetStats(db, domain, start, end, options)
+	metricStats.observeSince(started, domain)
 
 	if err != nil {
+		metricDbErrors.inc("stats")
 		ctx.StopWithError(500, err)
 		return
 	}
@@ -243,14 +234,36 @@ func main() {
 
 	defer d.Close()
 
-	MigrateDb(d)
-
 	db = d
 
+	if len(os.Args) > 1 {
+		err = MigrateDb(d)
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatal("Failed to migrate database")
+		}
+
+		err = registry.reload(d)
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatal("Failed to load sites")
+		}
+
+		code := runCommand(d, os.Args[1:])
+		_ = d.Close()
+		os.Exit(code)
+	}
+
 	tmpl := iris.Jet("./views", ".jet").Reload(true)
 	app.RegisterView(tmpl)
 	app.HandleDir("/public", iris.Dir("./public"))
-	app.Post("/ingest", handleIngest)
+	app.Post("/ingest", rejectUntilStarted, rejectDuringShutdown, authenticateIngest, handleIngest)
+	app.Post("/ingest/batch", rejectUntilStarted, rejectDuringShutdown, authenticateIngest, handleIngestBatch)
+	app.Get("/ingest/status", handlePipelineStatus)
+	app.Get("/metrics", handleMetrics)
+	app.Options("/beacon", handleBeaconPreflight)
+	app.Post("/beacon", rejectUntilStarted, rejectDuringShutdown, handleBeacon)
+	app.Get("/pixel.gif", rejectUntilStarted, rejectDuringShutdown, handlePixel)
 	app.Get("/", func(ctx iris.Context) {
 		renderView(ctx, "home", iris.Map{
 			"StartDate": time.Now().Add(time.Hour * -24).Format("2006-01-02"),
@@ -258,8 +271,46 @@ func main() {
 		})
 	})
 	app.Get("/stats", handleStatsRequest)
+	registerAdminRoutes(app)
+
+	err = bots.reload()
+
+	if err != nil {
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatal("Failed to load bot rules")
+	}
 
-	go handleRequests()
+	go bots.refresh()
 
-	_ = app.Listen(":3100")
+	if ChannelRulesFile != "" {
+		err = loadChannelRules(ChannelRulesFile)
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatal("Failed to load channel rules")
+		}
+	}
+
+	if SpoolDir != "" {
+		eventSpool, err = openSpool(SpoolDir)
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatal("Failed to open spool")
+		}
+	}
+
+	writeDb, err := sql.Open("postgres", ConnStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer writeDb.Close()
+
+	registerHealthRoutes(app, d, writeDb)
+
+	go startup(d, writeDb)
+
+	err = listenAndServe(app, ":3100")
+
+	if err != nil {
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatal("Failed to listen")
+	}
 }
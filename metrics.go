@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// max number of label combinations a metric keeps, further combinations are counted with every label set to "other"
+var MetricsMaxSeries = envInt("METRICS_MAX_SERIES", 1000)
+
+// upper bounds in seconds of the buckets of duration histograms
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// why an ingest request was turned away
+const (
+	rejectInvalid      = "invalid"
+	rejectSchema       = "schema"
+	rejectUnauthorized = "unauthorized"
+	rejectPipelineFull = "pipeline_full"
+	rejectShutdown     = "shutdown"
+	rejectStarting     = "starting"
+)
+
+// metric is anything that can write itself in the prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+// series is the value of one label combination of a metric
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+// metricVec is a counter or histogram with a fixed set of label names
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// gaugeFunc is a gauge, or counter, whose value is read when the metrics are scraped
+type gaugeFunc struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+var metrics = make([]metric, 0)
+
+func newCounter(name string, help string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*series)}
+	metrics = append(metrics, m)
+
+	return m
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: make(map[string]*series)}
+	metrics = append(metrics, m)
+
+	return m
+}
+
+func newGaugeFunc(name string, help string, kind string, value func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, kind: kind, value: value}
+	metrics = append(metrics, g)
+
+	return g
+}
+
+var (
+	metricAccepted = newCounter("trackma_events_accepted_total", "Events queued for writing.", "domain", "event")
+	metricRejected = newCounter("trackma_events_rejected_total", "Ingest requests turned away.", "reason")
+	metricInsert   = newHistogram("trackma_insert_duration_seconds", "Time spent copying the rows of a batch into a table.", durationBuckets, "table")
+	metricDbErrors = newCounter("trackma_db_errors_total", "Failed database operations.", "operation")
+	metricZZ       = newCounter("trackma_country_lookup_misses_total", "Events whose ip wasn't found in the ip2country database.", "domain")
+	metricStats    = newHistogram("trackma_stats_duration_seconds", "Time spent computing statistics.", durationBuckets, "domain")
+
+	metricDepth    = newGaugeFunc("trackma_pipeline_depth", "Events waiting in the pipeline.", "gauge", func() float64 { return float64(len(pipeline)) })
+	metricCapacity = newGaugeFunc("trackma_pipeline_capacity", "Events the pipeline can hold.", "gauge", func() float64 { return float64(cap(pipeline)) })
+	metricInFlight = newGaugeFunc("trackma_events_in_flight", "Events queued but not yet written or given up on.", "gauge", func() float64 { return float64(inFlightEvents.Load()) })
+	metricWritten  = newGaugeFunc("trackma_events_written_total", "Events written to the database.", "counter", func() float64 { return float64(writtenEvents.Load()) })
+	metricFailed   = newGaugeFunc("trackma_events_failed_total", "Events that couldn't be prepared or written.", "counter", func() float64 { return float64(failedEvents.Load()) })
+	metricExcluded = newGaugeFunc("trackma_events_excluded_total", "Events dropped as internal traffic or because of privacy signals.", "counter", func() float64 { return float64(excludedEvents.Load()) })
+)
+
+// get returns the series of a label combination, creating it if needed. m.mu must be held.
+func (m *metricVec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+
+	if ok {
+		return s
+	}
+
+	if len(m.series) >= MetricsMaxSeries {
+		values = make([]string, len(m.labels))
+
+		for i := range values {
+			values[i] = "other"
+		}
+
+		key = strings.Join(values, "\xff")
+
+		if s, ok := m.series[key]; ok {
+			return s
+		}
+	}
+
+	s = &series{labels: values, buckets: make([]uint64, len(m.buckets))}
+	m.series[key] = s
+
+	return s
+}
+
+func (m *metricVec) inc(values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.get(values).value++
+}
+
+func (m *metricVec) observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.get(values)
+	s.value += v
+	s.count++
+
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+}
+
+func (m *metricVec) observeSince(start time.Time, values ...string) {
+	m.observe(time.Since(start).Seconds(), values...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats label names and values as {name="value",...}, with extra appended as is
+func labelString(names []string, values []string, extra string) string {
+	pairs := make([]string, 0, len(names)+1)
+
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+
+		if m.kind != "histogram" {
+			_, _ = fmt.Fprintf(w, "%s%s %s\n", m.name, labelString(m.labels, s.labels, ""), formatValue(s.value))
+			continue
+		}
+
+		for i, bound := range m.buckets {
+			le := `le="` + formatValue(bound) + `"`
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.labels, le), s.buckets[i])
+		}
+
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.labels, `le="+Inf"`), s.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelString(m.labels, s.labels, ""), formatValue(s.value))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelString(m.labels, s.labels, ""), s.count)
+	}
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", g.name, g.help, g.name, g.kind, g.name, formatValue(g.value()))
+}
+
+// handleMetrics serves all metrics in the prometheus text format
+func handleMetrics(ctx iris.Context) {
+	ctx.ContentType("text/plain; version=0.0.4; charset=utf-8")
+
+	var b strings.Builder
+
+	for _, m := range metrics {
+		m.write(&b)
+	}
+
+	_, _ = ctx.WriteString(b.String())
+}
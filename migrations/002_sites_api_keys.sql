@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS sites
+(
+    domain  varchar   primary key,
+    created timestamp not null default current_timestamp
+);
+
+-- register every domain that already has events so existing sites keep working
+INSERT INTO sites (domain)
+SELECT DISTINCT domain FROM events
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS site_api_keys
+(
+    id      varchar   primary key,
+    domain  varchar   not null references sites (domain) on delete cascade,
+    secret  varchar   not null,
+    created timestamp not null default current_timestamp,
+    revoked timestamp
+);
+
+CREATE INDEX IF NOT EXISTS site_api_keys_domain_index
+    ON site_api_keys (domain);
@@ -0,0 +1,18 @@
+ALTER TABLE sites
+    ADD COLUMN IF NOT EXISTS timezone varchar not null default 'UTC';
+
+CREATE TABLE IF NOT EXISTS site_aliases
+(
+    alias  varchar primary key,
+    domain varchar not null references sites (domain) on delete cascade
+);
+
+CREATE INDEX IF NOT EXISTS site_aliases_domain_index
+    ON site_aliases (domain);
+
+-- stats used to treat www.<domain> as the site itself, keep that behaviour as an alias
+INSERT INTO site_aliases (alias, domain)
+SELECT 'www.' || domain, domain FROM sites
+WHERE domain NOT LIKE 'www.%'
+  AND 'www.' || domain NOT IN (SELECT domain FROM sites)
+ON CONFLICT DO NOTHING;
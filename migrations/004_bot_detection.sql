@@ -0,0 +1,7 @@
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS is_bot boolean not null default false,
+    ADD COLUMN IF NOT EXISTS bot_reason varchar;
+
+ALTER TABLE monthly_traffic
+    ADD COLUMN IF NOT EXISTS is_bot boolean not null default false,
+    ADD COLUMN IF NOT EXISTS bot_reason varchar;
@@ -0,0 +1,17 @@
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS browser varchar,
+    ADD COLUMN IF NOT EXISTS browser_version varchar,
+    ADD COLUMN IF NOT EXISTS os varchar,
+    ADD COLUMN IF NOT EXISTS os_version varchar,
+    ADD COLUMN IF NOT EXISTS device_type varchar;
+
+ALTER TABLE monthly_traffic
+    ADD COLUMN IF NOT EXISTS browser varchar,
+    ADD COLUMN IF NOT EXISTS browser_version varchar,
+    ADD COLUMN IF NOT EXISTS os varchar,
+    ADD COLUMN IF NOT EXISTS os_version varchar,
+    ADD COLUMN IF NOT EXISTS device_type varchar;
+
+-- used by the user agent backfill to find rows that haven't been parsed
+CREATE INDEX IF NOT EXISTS events_unparsed_user_agent_index
+    ON events (user_agent) WHERE browser IS NULL;
@@ -0,0 +1,19 @@
+-- what to do with internal traffic, either 'drop' it or 'tag' it with is_internal
+ALTER TABLE sites
+    ADD COLUMN IF NOT EXISTS internal_traffic varchar not null default 'drop';
+
+CREATE TABLE IF NOT EXISTS exclusion_rules
+(
+    id      serial    primary key,
+    domain  varchar   not null references sites (domain) on delete cascade,
+    kind    varchar   not null,
+    value   varchar   not null,
+    created timestamp not null default current_timestamp,
+    unique (domain, kind, value)
+);
+
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS is_internal boolean not null default false;
+
+ALTER TABLE monthly_traffic
+    ADD COLUMN IF NOT EXISTS is_internal boolean not null default false;
@@ -0,0 +1,10 @@
+-- 'daily_salt' hashes visitors with a secret salt that changes every day, 'stable' keeps the unsalted hash
+ALTER TABLE sites
+    ADD COLUMN IF NOT EXISTS visitor_id_mode varchar not null default 'daily_salt';
+
+-- only the salt of the current day is kept, older salts are deleted when the day changes
+CREATE TABLE IF NOT EXISTS visitor_salts
+(
+    day  date  primary key,
+    salt bytea not null
+);
@@ -0,0 +1,13 @@
+-- what is stored of client ips in monthly_traffic, the 'full' address, a 'truncate'd prefix or nothing when set to 'drop'
+ALTER TABLE sites
+    ADD COLUMN IF NOT EXISTS ip_policy varchar not null default 'full';
+
+ALTER TABLE monthly_traffic
+    ALTER COLUMN ip DROP NOT NULL;
+
+-- set once ip and ips no longer hold full addresses, either at ingest or by the anonymization job
+ALTER TABLE monthly_traffic
+    ADD COLUMN IF NOT EXISTS ip_anonymized boolean not null default false;
+
+CREATE INDEX IF NOT EXISTS monthly_traffic_ip_not_anonymized_index
+    ON monthly_traffic (timestamp) WHERE NOT ip_anonymized;
@@ -0,0 +1,10 @@
+-- days rows of a site are kept, null uses the global default and 0 keeps them forever
+ALTER TABLE sites
+    ADD COLUMN IF NOT EXISTS traffic_retention_days int,
+    ADD COLUMN IF NOT EXISTS events_retention_days int;
+
+CREATE INDEX IF NOT EXISTS events_domain_timestamp_index
+    ON events (domain, timestamp);
+
+CREATE INDEX IF NOT EXISTS monthly_traffic_domain_timestamp_index
+    ON monthly_traffic (domain, timestamp);
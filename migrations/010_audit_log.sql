@@ -0,0 +1,11 @@
+-- record of data subject exports and erasures
+CREATE TABLE IF NOT EXISTS audit_log
+(
+    id        serial    primary key,
+    timestamp timestamp not null default current_timestamp,
+    actor     varchar   not null,
+    action    varchar   not null,
+    subject   jsonb     not null,
+    events    bigint    not null,
+    traffic   bigint    not null
+);
@@ -0,0 +1,22 @@
+-- what happens to events with a do not track, global privacy control or denied consent signal:
+-- 'drop' them, 'anonymize' them by storing them without visitor id, session id and ip, or 'ignore' the signal
+ALTER TABLE sites
+    ADD COLUMN IF NOT EXISTS privacy_signals varchar not null default 'anonymize';
+
+ALTER TABLE events
+    ALTER COLUMN visitor_id DROP NOT NULL;
+
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS privacy_anonymized boolean not null default false;
+
+ALTER TABLE monthly_traffic
+    ADD COLUMN IF NOT EXISTS privacy_anonymized boolean not null default false;
+
+-- dropped events aren't stored, only counted per site and day
+CREATE TABLE IF NOT EXISTS privacy_drops
+(
+    domain varchar not null,
+    day    date    not null,
+    events bigint  not null,
+    primary key (domain, day)
+);
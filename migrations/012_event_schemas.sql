@@ -0,0 +1,30 @@
+-- what happens to events whose event_data doesn't match their schema: 'reject' them at ingest, 'quarantine' them
+-- in quarantined_events or 'flag' them by storing the violation in events.schema_error
+ALTER TABLE sites
+    ADD COLUMN IF NOT EXISTS schema_mode varchar not null default 'flag';
+
+CREATE TABLE IF NOT EXISTS event_schemas
+(
+    domain     varchar   not null references sites (domain) on delete cascade,
+    event_name varchar   not null,
+    schema     jsonb     not null,
+    created    timestamp not null default current_timestamp,
+    primary key (domain, event_name)
+);
+
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS schema_error varchar;
+
+CREATE TABLE IF NOT EXISTS quarantined_events
+(
+    id         serial    primary key,
+    timestamp  timestamp not null,
+    domain     varchar   not null,
+    event_name varchar   not null,
+    path       varchar,
+    event_data varchar,
+    error      varchar   not null
+);
+
+CREATE INDEX IF NOT EXISTS quarantined_events_domain_timestamp_index
+    ON quarantined_events (domain, timestamp);
@@ -0,0 +1,20 @@
+-- query parameters used to be stored as a flat string map keeping only the first value of every key,
+-- they are now stored as a map of arrays with all values. Existing rows are converted in batches by
+-- the backfill-query-params command, rows stored from now on are already converted.
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS query_params_converted boolean;
+
+ALTER TABLE events
+    ALTER COLUMN query_params_converted SET DEFAULT true;
+
+CREATE INDEX IF NOT EXISTS events_unconverted_query_params_index
+    ON events (timestamp) WHERE query_params_converted IS NULL;
+
+ALTER TABLE monthly_traffic
+    ADD COLUMN IF NOT EXISTS query_params_converted boolean;
+
+ALTER TABLE monthly_traffic
+    ALTER COLUMN query_params_converted SET DEFAULT true;
+
+CREATE INDEX IF NOT EXISTS monthly_traffic_unconverted_query_params_index
+    ON monthly_traffic (timestamp) WHERE query_params_converted IS NULL;
@@ -0,0 +1,24 @@
+-- how paths are normalized before the path rules are applied
+ALTER TABLE sites
+    ADD COLUMN IF NOT EXISTS strip_index boolean not null default true,
+    ADD COLUMN IF NOT EXISTS strip_trailing_slash boolean not null default true,
+    ADD COLUMN IF NOT EXISTS lowercase_paths boolean not null default false;
+
+-- regex rewrites of paths into templates, e.g. ^/product/\d+$ to /product/:id, the first matching rule is applied
+CREATE TABLE IF NOT EXISTS path_rules
+(
+    id       serial    primary key,
+    domain   varchar   not null references sites (domain) on delete cascade,
+    pattern  varchar   not null,
+    template varchar   not null,
+    created  timestamp not null default current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS path_rules_domain_index
+    ON path_rules (domain);
+
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS normalized_path varchar;
+
+ALTER TABLE monthly_traffic
+    ADD COLUMN IF NOT EXISTS normalized_path varchar;
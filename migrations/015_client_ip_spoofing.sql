@@ -0,0 +1,3 @@
+-- set when the forwarding chain of a request contained addresses no trusted proxy vouches for
+ALTER TABLE monthly_traffic
+    ADD COLUMN IF NOT EXISTS ip_spoofed boolean not null default false;
@@ -0,0 +1,3 @@
+-- used by the user agent backfill to find traffic rows that haven't been parsed, events got theirs in 005
+CREATE INDEX IF NOT EXISTS monthly_traffic_unparsed_user_agent_index
+    ON monthly_traffic (user_agent) WHERE browser IS NULL;
@@ -20,38 +20,60 @@ var (
 	Root = filepath.Join(filepath.Dir(b))
 )
 
-func MigrateDb(db *sql.DB) {
-	createMigrationsTable(db)
-	currentVersion := getCurrentMigratedVersion(db)
-	availableVersions := getAvailableMigrations(currentVersion)
+// MigrateDb applies the migrations newer than the version recorded in migration_history
+func MigrateDb(db *sql.DB) error {
+	err := createMigrationsTable(db)
+
+	if err != nil {
+		return fmt.Errorf("failed to create migrations history table: %w", err)
+	}
+
+	currentVersion, err := getCurrentMigratedVersion(db)
+
+	if err != nil {
+		return fmt.Errorf("failed to get latest migration version: %w", err)
+	}
+
+	availableVersions, err := getAvailableMigrations(currentVersion)
+
+	if err != nil {
+		return fmt.Errorf("failed to get available migrations: %w", err)
+	}
 
 	var appliedVersion = currentVersion
 
 	for _, filePath := range *availableVersions {
 		c, err := os.ReadFile(filePath)
 		if err != nil {
-			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatalf("Error reading migration file %s", filePath)
+			return fmt.Errorf("error reading migration file %s: %w", filePath, err)
 		}
 
 		script := string(c)
 		_, err = db.Exec(script)
 		if err != nil {
-			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatalf("Failed to apply migration file %s", filePath)
+			return fmt.Errorf("failed to apply migration file %s: %w", filePath, err)
 		}
 
 		y := strings.Split(filePath, "/")
 		x, err := getVersionFromFileName(y[len(y)-1])
 
 		if err != nil {
-			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatalf("Failed to get version from filename %s", filePath)
+			return fmt.Errorf("failed to get version from filename %s: %w", filePath, err)
 		}
 
 		appliedVersion = x
-	}
 
-	if appliedVersion != currentVersion {
-		writeCurrentVersion(db, appliedVersion)
+		// recorded after every file so a failing migration doesn't make the ones before it run again
+		err = writeCurrentVersion(db, appliedVersion)
+
+		if err != nil {
+			return fmt.Errorf("failed to write migration version: %w", err)
+		}
+
+		log.WithFields(log.Fields{"version": appliedVersion}).Info("Applied migration")
 	}
+
+	return nil
 }
 
 func getVersionFromFileName(fileName string) (int16, error) {
@@ -66,34 +88,30 @@ func getVersionFromFileName(fileName string) (int16, error) {
 	}
 }
 
-func createMigrationsTable(db *sql.DB) {
+func createMigrationsTable(db *sql.DB) error {
 	_, err := db.Exec("CREATE TABLE IF NOT EXISTS migration_history (version SMALLINT PRIMARY KEY, migrated TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)")
 
-	if err != nil {
-		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatal("Failed to create migrations history table")
-	}
+	return err
 }
 
-func getCurrentMigratedVersion(db *sql.DB) int16 {
+func getCurrentMigratedVersion(db *sql.DB) (int16, error) {
 
 	var version int16
-	err := db.QueryRow("SELECT version FROM migration_history ORDER BY migrated DESC LIMIT 1").Scan(&version)
+	err := db.QueryRow("SELECT version FROM migration_history ORDER BY version DESC LIMIT 1").Scan(&version)
 
 	if errors.Is(err, sql.ErrNoRows) {
-		return 0
-	} else if err != nil {
-		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatal("Failed to get latest migration version")
+		return 0, nil
 	}
 
-	return version
+	return version, err
 }
 
-func getAvailableMigrations(currentVersion int16) *[]string {
+func getAvailableMigrations(currentVersion int16) (*[]string, error) {
 	path := filepath.Join(Root, "migrations")
 	files, err := os.ReadDir(path)
 
 	if err != nil {
-		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatal("Failed to get available migrations")
+		return nil, err
 	}
 
 	var result = make([]string, 0)
@@ -108,19 +126,32 @@ func getAvailableMigrations(currentVersion int16) *[]string {
 				log.WithFields(log.Fields{"currentVersion": currentVersion}).Debugf("Skipping migration %s", file.Name())
 			}
 		} else {
-			log.WithFields(log.Fields{"file": file.Name()}).Fatalf("Failed to get version from file %s", file.Name())
+			return nil, fmt.Errorf("failed to get version from file %s", file.Name())
 		}
 	}
 
 	sort.Strings(result)
 
-	return &result
+	return &result, nil
 }
 
-func writeCurrentVersion(db *sql.DB, currentVersion int16) {
-	_, err := db.Exec("INSERT INTO migration_history (version) VALUES ($1)", currentVersion)
+// latestMigrationVersion returns the version of the newest migration file
+func latestMigrationVersion() (int16, error) {
+	files, err := getAvailableMigrations(0)
 
 	if err != nil {
-		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Fatalf("Failed to write migration version")
+		return 0, err
 	}
+
+	if len(*files) == 0 {
+		return 0, nil
+	}
+
+	return getVersionFromFileName(filepath.Base((*files)[len(*files)-1]))
+}
+
+func writeCurrentVersion(db *sql.DB, currentVersion int16) error {
+	_, err := db.Exec("INSERT INTO migration_history (version) VALUES ($1)", currentVersion)
+
+	return err
 }
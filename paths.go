@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+)
+
+// pathRule rewrites paths matching a regular expression, e.g. ^/product/\d+$ with the template /product/:id.
+// The template may refer to groups of the pattern with $1 or ${name}.
+type pathRule struct {
+	Id       int    `json:"id"`
+	Domain   string `json:"domain"`
+	Pattern  string `json:"pattern"`
+	Template string `json:"template"`
+
+	re *regexp.Regexp
+}
+
+// pathOptions are the normalizations applied before the path rules
+type pathOptions struct {
+	StripIndex         bool `json:"strip_index"`
+	StripTrailingSlash bool `json:"strip_trailing_slash"`
+	LowercasePaths     bool `json:"lowercase_paths"`
+}
+
+// path options of sites that aren't registered
+var defaultPathOptions = pathOptions{StripIndex: true, StripTrailingSlash: true}
+
+func (r *pathRule) compile() error {
+	if r.Template == "" {
+		return fmt.Errorf("template can't be empty")
+	}
+
+	re, err := regexp.Compile(r.Pattern)
+
+	if err != nil {
+		return fmt.Errorf("invalid pattern %s: %w", r.Pattern, err)
+	}
+
+	r.re = re
+
+	return nil
+}
+
+// normalizePath strips index files and trailing slashes, lowercases the path if enabled and then
+// applies the first matching path rule. The root path is always kept as "/".
+func normalizePath(options pathOptions, rules []pathRule, path string) string {
+	if options.StripIndex {
+		for _, index := range []string{"index.html", "index.htm", "index.php"} {
+			if strings.HasSuffix(path, "/"+index) {
+				path = strings.TrimSuffix(path, index)
+				break
+			}
+		}
+	}
+
+	if options.StripTrailingSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	if options.LowercasePaths {
+		path = strings.ToLower(path)
+	}
+
+	for _, r := range rules {
+		if r.re.MatchString(path) {
+			return r.re.ReplaceAllString(path, r.Template)
+		}
+	}
+
+	return path
+}
+
+// normalizedPath normalizes a path with the options and rules of the site of domain
+func normalizedPath(domain string, path string) string {
+	if s, ok := registry.resolve(domain); ok {
+		return normalizePath(s.PathOptions, s.PathRules, path)
+	}
+
+	return normalizePath(defaultPathOptions, nil, path)
+}
+
+func loadPathRules(db *sql.DB) ([]pathRule, error) {
+	rows, err := db.Query("SELECT id, domain, pattern, template FROM public.path_rules ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]pathRule, 0)
+
+	for rows.Next() {
+		var r pathRule
+		err := rows.Scan(&r.Id, &r.Domain, &r.Pattern, &r.Template)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if r.compile() != nil {
+			continue
+		}
+
+		result = append(result, r)
+	}
+
+	return result, rows.Err()
+}
+
+func addPathRule(db *sql.DB, domain string, pattern string, template string) (*pathRule, error) {
+	r := pathRule{Domain: domain, Pattern: pattern, Template: template}
+	err := r.compile()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.QueryRow("INSERT INTO public.path_rules (domain, pattern, template) VALUES ($1, $2, $3) RETURNING id", r.Domain, r.Pattern, r.Template).Scan(&r.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, registry.reload(db)
+}
+
+func removePathRule(db *sql.DB, domain string, id int) error {
+	res, err := db.Exec("DELETE FROM public.path_rules WHERE id = $1 AND domain = $2", id, domain)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no path rule %d for %s", id, domain)
+	}
+
+	return registry.reload(db)
+}
+
+func pathOptionsSettings(options pathOptions) []siteSetting {
+	return []siteSetting{
+		{column: "strip_index", value: options.StripIndex},
+		{column: "strip_trailing_slash", value: options.StripTrailingSlash},
+		{column: "lowercase_paths", value: options.LowercasePaths},
+	}
+}
+
+// number of distinct paths renormalizePaths updates per statement
+const renormalizeBatchSize = 1000
+
+// renormalizePaths re-applies the path rules of a site to its stored rows. The normalized path of every distinct
+// path is computed once and the rows of a table are updated from that mapping in batches of distinct paths, so
+// no single statement holds its locks for long.
+func renormalizePaths(db *sql.DB, s *site) (int64, error) {
+	var updated int64 = 0
+
+	for _, table := range []string{"events", "monthly_traffic"} {
+		rows, err := db.Query("SELECT DISTINCT path FROM public."+table+" WHERE domain = $1 AND path IS NOT NULL", s.Domain)
+
+		if err != nil {
+			return updated, err
+		}
+
+		paths := make([]string, 0)
+
+		for rows.Next() {
+			var path string
+			err := rows.Scan(&path)
+
+			if err != nil {
+				rows.Close()
+				return updated, err
+			}
+
+			paths = append(paths, path)
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return updated, err
+		}
+
+		var rowsUpdated int64 = 0
+
+		for start := 0; start < len(paths); start += renormalizeBatchSize {
+			n, err := updateNormalizedPaths(db, s, table, paths[start:min(start+renormalizeBatchSize, len(paths))])
+			updated += n
+			rowsUpdated += n
+
+			if err != nil {
+				return updated, err
+			}
+		}
+
+		log.WithFields(log.Fields{"domain": s.Domain, "table": table, "paths": len(paths), "rows": rowsUpdated}).Info("Normalized paths")
+	}
+
+	return updated, nil
+}
+
+func updateNormalizedPaths(db *sql.DB, s *site, table string, paths []string) (int64, error) {
+	normalized := make([]string, len(paths))
+
+	for i, path := range paths {
+		normalized[i] = normalizePath(s.PathOptions, s.PathRules, path)
+	}
+
+	res, err := db.Exec("UPDATE public."+table+" t SET normalized_path = m.normalized_path "+
+		"FROM unnest($2::varchar[], $3::varchar[]) AS m(path, normalized_path) "+
+		"WHERE t.domain = $1 AND t.path = m.path AND t.normalized_path IS DISTINCT FROM m.normalized_path",
+		s.Domain, pq.Array(paths), pq.Array(normalized))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestNormalizePath(t *testing.T) {
+	rules := []pathRule{
+		{Pattern: `^/product/\d+$`, Template: "/product/:id"},
+		{Pattern: `^/blog/(?P<year>\d{4})/[^/]+$`, Template: "/blog/${year}/:slug"},
+		{Pattern: `^/product/.+$`, Template: "/product/other"},
+	}
+
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all := pathOptions{StripIndex: true, StripTrailingSlash: true, LowercasePaths: true}
+
+	tests := []struct {
+		name    string
+		options pathOptions
+		rules   []pathRule
+		path    string
+		want    string
+	}{
+		{"no options", pathOptions{}, nil, "/About/index.html", "/About/index.html"},
+		{"strip index", pathOptions{StripIndex: true}, nil, "/about/index.html", "/about/"},
+		{"strip index php", pathOptions{StripIndex: true}, nil, "/about/index.php", "/about/"},
+		{"index needs its own segment", pathOptions{StripIndex: true}, nil, "/myindex.html", "/myindex.html"},
+		{"strip trailing slash", pathOptions{StripTrailingSlash: true}, nil, "/about//", "/about"},
+		{"root is kept", all, nil, "/", "/"},
+		{"root index is the root", all, nil, "/index.html", "/"},
+		{"lowercase", pathOptions{LowercasePaths: true}, nil, "/About", "/about"},
+		{"defaults don't lowercase", defaultPathOptions, nil, "/About/index.htm", "/About"},
+		{"rule", all, rules, "/product/42", "/product/:id"},
+		{"rule after the options", all, rules, "/Product/42/", "/product/:id"},
+		{"named group", all, rules, "/blog/2024/hello-world", "/blog/2024/:slug"},
+		{"first matching rule wins", all, rules, "/product/shoes", "/product/other"},
+		{"no matching rule", all, rules, "/pricing", "/pricing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizePath(tt.options, tt.rules, tt.path); got != tt.want {
+				t.Errorf("normalizePath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathRuleCompile(t *testing.T) {
+	if err := (&pathRule{Pattern: "(", Template: "/x"}).compile(); err == nil {
+		t.Error("compile() accepted an invalid pattern")
+	}
+
+	if err := (&pathRule{Pattern: "^/x$"}).compile(); err == nil {
+		t.Error("compile() accepted an empty template")
+	}
+}
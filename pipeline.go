@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queuedEvent is an ingest request waiting in the pipeline. Since events are written in batches
+// the time it was received is kept so the stored timestamp doesn't depend on when the batch is flushed.
+type queuedEvent struct {
+	Request  IngestRequest
+	Received time.Time
+	segment  *spoolSegment
+}
+
+// seconds a client is told to wait before retrying when the pipeline is full
+var IngestRetryAfter = envInt("INGEST_RETRY_AFTER", 5)
+
+var pipeline = make(chan queuedEvent, PipelineCapacity)
+
+// guards against sending on the pipeline after it has been closed for shutdown
+var pipelineMu sync.RWMutex
+var pipelineClosed bool
+
+var (
+	acceptedEvents atomic.Int64
+	rejectedEvents atomic.Int64
+	droppedEvents  atomic.Int64
+	writtenEvents  atomic.Int64
+	failedEvents   atomic.Int64
+	excludedEvents atomic.Int64
+	inFlightEvents atomic.Int64
+)
+
+type pipelineStatus struct {
+	Capacity int   `json:"capacity"`
+	Depth    int   `json:"depth"`
+	Accepted int64 `json:"accepted"`
+	Rejected int64 `json:"rejected"`
+	Dropped  int64 `json:"dropped"`
+	Written  int64 `json:"written"`
+	Failed   int64 `json:"failed"`
+	Excluded int64 `json:"excluded"`
+
+	Workers []workerStatus `json:"workers"`
+}
+
+// enqueue puts a validated ingest request on the pipeline without blocking. It returns false
+// and counts the event as dropped if the pipeline is full.
+func enqueue(request IngestRequest) bool {
+	e := queuedEvent{Request: request, Received: time.Now().UTC()}
+	var queued bool
+
+	pipelineMu.RLock()
+	defer pipelineMu.RUnlock()
+
+	if pipelineClosed {
+		droppedEvents.Add(1)
+		metricRejected.inc(rejectShutdown)
+		return false
+	}
+
+	var err error
+
+	if eventSpool != nil {
+		queued, err = eventSpool.enqueue(e)
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "domain": request.Domain}).Error("Failed to write event to spool, queueing it in memory")
+		}
+	}
+
+	// without the spool, or if writing to it failed, the event is only kept in memory
+	if eventSpool == nil || err != nil {
+		select {
+		case pipeline <- e:
+			queued = true
+		default:
+		}
+	}
+
+	if !queued {
+		dropped := droppedEvents.Add(1)
+		log.WithFields(log.Fields{"domain": request.Domain, "dropped": dropped}).Warn("Pipeline is full, dropping event")
+		metricRejected.inc(rejectPipelineFull)
+		return false
+	}
+
+	acceptedEvents.Add(1)
+	metricAccepted.inc(request.Domain, request.EventName)
+	inFlightEvents.Add(1)
+	return true
+}
+
+// closePipeline stops the spool and closes the pipeline so the writer knows nothing more is coming
+func closePipeline() {
+	pipelineMu.Lock()
+	defer pipelineMu.Unlock()
+
+	if pipelineClosed {
+		return
+	}
+
+	if eventSpool != nil {
+		eventSpool.close()
+	}
+
+	pipelineClosed = true
+	close(pipeline)
+}
+
+// rejectEvent counts an ingest request that failed validation or authorization
+func rejectEvent(reason string) {
+	rejectedEvents.Add(1)
+	metricRejected.inc(reason)
+}
+
+// validationRejectReason returns the reason an error of validateIngestRequest is counted with
+func validationRejectReason(err error) string {
+	if errors.Is(err, errInvalidEventData) {
+		return rejectSchema
+	}
+
+	return rejectInvalid
+}
+
+// stopPipelineFull responds to a request that couldn't be queued
+func stopPipelineFull(ctx iris.Context) {
+	ctx.Header("Retry-After", strconv.Itoa(IngestRetryAfter))
+	ctx.StopWithStatus(iris.StatusServiceUnavailable)
+}
+
+func getPipelineStatus() pipelineStatus {
+	status := pipelineStatus{
+		Capacity: cap(pipeline),
+		Depth:    len(pipeline),
+		Accepted: acceptedEvents.Load(),
+		Rejected: rejectedEvents.Load(),
+		Dropped:  droppedEvents.Load(),
+		Written:  writtenEvents.Load(),
+		Failed:   failedEvents.Load(),
+		Excluded: excludedEvents.Load(),
+	}
+
+	ingestWorkersMu.RLock()
+	defer ingestWorkersMu.RUnlock()
+
+	status.Workers = make([]workerStatus, len(ingestWorkers))
+
+	for i, w := range ingestWorkers {
+		status.Workers[i] = w.status()
+	}
+
+	return status
+}
+
+func handlePipelineStatus(ctx iris.Context) {
+	_ = ctx.JSON(getPipelineStatus())
+}
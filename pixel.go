@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+)
+
+// 1x1 transparent gif
+var transparentGif = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+var utmParams = []string{"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content"}
+
+func writePixel(ctx iris.Context) {
+	ctx.Header("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	ctx.Header("Pragma", "no-cache")
+	ctx.Header("Expires", "0")
+	ctx.ContentType("image/gif")
+	_, _ = ctx.Write(transparentGif)
+}
+
+// handlePixel ingests an event from an image request, for pages that can't run javascript.
+// Domain and path fall back to the page in the Referer header when they aren't given as parameters.
+// The gif is returned even if the event is rejected so pages never show a broken image.
+func handlePixel(ctx iris.Context) {
+	defer writePixel(ctx)
+
+	dnt, gpc := browserPrivacySignals(ctx)
+
+	ingestBody := IngestRequest{
+		Domain:          ctx.URLParam("domain"),
+		Path:            ctx.URLParam("path"),
+		EventName:       ctx.URLParamDefault("event", "page_view"),
+		Referrer:        ctx.URLParam("referrer"),
+		ClientIp:        browserClientIps(ctx),
+		ClientUserAgent: ctx.GetHeader("User-Agent"),
+		StatusCode:      200,
+		Dnt:             dnt,
+		Gpc:             gpc,
+		Consent:         ctx.URLParam("consent"),
+	}
+
+	if page, err := url.Parse(ctx.GetHeader("Referer")); err == nil && page.Host != "" {
+		if ingestBody.Domain == "" {
+			ingestBody.Domain = page.Hostname()
+		}
+
+		if ingestBody.Path == "" {
+			ingestBody.Path = page.Path
+		}
+	}
+
+	query := url.Values{}
+
+	for _, key := range utmParams {
+		if v := ctx.URLParam(key); v != "" {
+			query.Set(key, v)
+		}
+	}
+
+	ingestBody.Query = query.Encode()
+
+	resolveClientIp(&ingestBody, clientIpRightmostUntrusted)
+	err := validateIngestRequest(&ingestBody)
+
+	if err != nil {
+		rejectEvent(validationRejectReason(err))
+		log.WithFields(log.Fields{"error": err.Error()}).Debug("Rejected pixel request")
+		return
+	}
+
+	enqueue(ingestBody)
+}
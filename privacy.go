@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// what happens to events of visitors that opted out of tracking
+const (
+	privacySignalsDrop      = "drop"
+	privacySignalsAnonymize = "anonymize"
+	privacySignalsIgnore    = "ignore"
+)
+
+// consent states an event can carry, an empty consent means it is unknown
+const (
+	consentGranted = "granted"
+	consentDenied  = "denied"
+)
+
+// optedOut reports whether the visitor asked not to be tracked, explicitly granted consent overrides do not track and
+// global privacy control
+func (r *IngestRequest) optedOut() bool {
+	if r.Consent == consentGranted {
+		return false
+	}
+
+	return r.Consent == consentDenied || r.Dnt || r.Gpc
+}
+
+// privacyAction returns how an event is stored given its privacy signals and the policy of its site
+func privacyAction(request *IngestRequest) string {
+	if !request.optedOut() {
+		return privacySignalsIgnore
+	}
+
+	if s, ok := registry.resolve(normalizeDomain(request.Domain)); ok {
+		return s.PrivacySignals
+	}
+
+	return privacySignalsAnonymize
+}
+
+// privacyDrop identifies a row of privacy_drops
+type privacyDrop struct {
+	domain string
+	day    string
+}
+
+func newPrivacyDrop(e queuedEvent) privacyDrop {
+	return privacyDrop{domain: normalizeDomain(e.Request.Domain), day: e.Received.UTC().Format(time.DateOnly)}
+}
+
+// countPrivacyDrops adds the number of dropped events per site and day to privacy_drops
+func countPrivacyDrops(tx *sql.Tx, drops map[privacyDrop]int64) error {
+	for d, n := range drops {
+		_, err := tx.Exec("INSERT INTO public.privacy_drops (domain, day, events) VALUES ($1, $2, $3) ON CONFLICT (domain, day) DO UPDATE SET events = privacy_drops.events + excluded.events",
+			d.domain, d.day, n)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func privacySignalsSetting(policy string) siteSetting {
+	if policy != privacySignalsDrop && policy != privacySignalsAnonymize && policy != privacySignalsIgnore {
+		return siteSetting{err: fmt.Errorf("privacy signals must be %s, %s or %s", privacySignalsDrop, privacySignalsAnonymize, privacySignalsIgnore)}
+	}
+
+	return siteSetting{column: "privacy_signals", value: policy}
+}
@@ -379,8 +379,42 @@ class Stats {
         }).render();
     }
 
+    updateVisitorsPerDimension = (elementId, values, title) => {
+        let sortable = Object.entries(values ?? {})
+        sortable.sort((a, b) => b[1] - a[1]);
+        sortable = sortable.slice(0, 10)
+
+        const data = [];
+        for (const pair of sortable) {
+            data.push({
+                x: pair[0],
+                y: pair[1]
+            })
+        }
+
+        new ApexCharts(document.getElementById(elementId), {
+            chart: {
+                id: elementId,
+                type: 'bar',
+                height: this.barChartHeight
+            },
+            plotOptions: {
+                bar: {
+                    horizontal: true
+                }
+            },
+            title: {
+                text: title
+            },
+            series: [{
+                data
+            }],
+        }).render();
+    }
+
     updateData = () => {
         document.getElementById("total-visitors").textContent = this.numberFormatter.format(this.data.total_visitors);
+        document.getElementById("total-visitors").title = (this.data.warnings || []).join("\n");
         document.getElementById("total-page-views").textContent = this.numberFormatter.format(this.data.total_page_views);
         document.getElementById('subscriptions-started').textContent = this.numberFormatter.format(this.data.subscriptions_started);
         document.getElementById('orders-completed').textContent = this.numberFormatter.format(this.data.orders_completed);
@@ -394,6 +428,10 @@ class Stats {
         this.updateVisitorsPerCountry();
         this.updateReferrers();
         this.updateVisitorsPerUtmSource();
+        this.updateVisitorsPerDimension('visitors-per-browser', this.data.visitors_per_browser, 'Visitors per browser');
+        this.updateVisitorsPerDimension('visitors-per-os', this.data.visitors_per_os, 'Visitors per operating system');
+        this.updateVisitorsPerDimension('visitors-per-device', this.data.visitors_per_device, 'Visitors per device');
+        this.updateVisitorsPerDimension('page-views-per-path', this.data.page_views_per_path, 'Top pages');
 
         document.getElementById('spinner').classList.add('hidden');
         document.getElementById('hider').classList.remove('hidden');
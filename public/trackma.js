@@ -0,0 +1,85 @@
+// Trackma browser tracker
+//
+// <script defer src="https://trackma.example.com/public/trackma.js" data-domain="example.com"></script>
+//
+// A page view is sent when the script loads and whenever the page is navigated with history.pushState.
+// Custom events are sent with trackma.event('signup_clicked', { plan: 'pro' }).
+// Add data-manual to the script tag to disable automatic page views and call trackma.pageView() yourself.
+// Pass the visitor's consent with data-consent="granted" or "denied", or later with trackma.consent('granted').
+(function () {
+    const script = document.currentScript;
+
+    if (!script) return;
+
+    const endpoint = new URL('/beacon', script.src).toString();
+    const domain = script.getAttribute('data-domain') || window.location.hostname;
+    const sessionKey = 'trackma_session';
+    let consent = script.getAttribute('data-consent') || '';
+
+    const getSessionId = () => {
+        try {
+            let id = window.sessionStorage.getItem(sessionKey);
+
+            if (!id) {
+                id = Math.random().toString(36).substring(2) + Date.now().toString(36);
+                window.sessionStorage.setItem(sessionKey, id);
+            }
+
+            return id;
+        } catch (err) {
+            return '';
+        }
+    };
+
+    const send = (eventName, eventData) => {
+        const payload = {
+            domain: domain,
+            path: window.location.pathname,
+            query: window.location.search,
+            eventName: eventName,
+            sessionId: getSessionId(),
+            referrer: document.referrer,
+            statusCode: 200,
+            eventData: eventData === undefined ? '' : JSON.stringify(eventData),
+            consent: consent
+        };
+
+        const body = JSON.stringify(payload);
+
+        // text/plain is a cors safelisted content type, so no preflight is needed
+        if (navigator.sendBeacon && navigator.sendBeacon(endpoint, new Blob([body], { type: 'text/plain' }))) {
+            return;
+        }
+
+        fetch(endpoint, { method: 'POST', body: body, keepalive: true, mode: 'cors', headers: { 'Content-Type': 'text/plain' } }).catch(() => {});
+    };
+
+    let lastPath = null;
+
+    const pageView = () => {
+        if (lastPath === window.location.pathname + window.location.search) return;
+
+        lastPath = window.location.pathname + window.location.search;
+        send('page_view');
+    };
+
+    window.trackma = {
+        pageView: pageView,
+        event: (name, data) => send(name, data),
+        consent: (state) => {
+            consent = state;
+        }
+    };
+
+    if (script.hasAttribute('data-manual')) return;
+
+    const pushState = history.pushState;
+
+    history.pushState = function () {
+        pushState.apply(this, arguments);
+        pageView();
+    };
+
+    window.addEventListener('popstate', pageView);
+    pageView();
+})();
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+)
+
+// number of rows the query parameter backfill converts per statement
+const queryParamsBackfillBatchSize = 10000
+
+// sqlArrayQueryParams is the sql equivalent of storing every value of the query_params column as an array,
+// values that already are arrays are kept
+const sqlArrayQueryParams = "CASE WHEN EXISTS (SELECT 1 FROM jsonb_each(query_params) WHERE jsonb_typeof(value) <> 'array') " +
+	"THEN (SELECT jsonb_object_agg(key, CASE WHEN jsonb_typeof(value) = 'array' THEN value ELSE jsonb_build_array(value) END) FROM jsonb_each(query_params)) " +
+	"ELSE query_params END"
+
+// backfillQueryParams converts the query parameters of rows stored before every value of a parameter was kept, a
+// batch at a time so no statement locks many rows for long. Rows that were converted are marked so the backfill
+// can be stopped and run again.
+func backfillQueryParams(db *sql.DB) (int64, error) {
+	var updated int64 = 0
+
+	for _, table := range []string{"events", "monthly_traffic"} {
+		query := "UPDATE public." + table + " SET query_params = CASE WHEN jsonb_typeof(query_params) = 'object' THEN " + sqlArrayQueryParams + " ELSE query_params END, " +
+			"query_params_converted = true " +
+			"WHERE ctid IN (SELECT ctid FROM public." + table + " WHERE query_params_converted IS NULL LIMIT $1)"
+
+		for {
+			res, err := db.Exec(query, queryParamsBackfillBatchSize)
+
+			if err != nil {
+				return updated, err
+			}
+
+			n, _ := res.RowsAffected()
+			updated += n
+
+			log.WithFields(log.Fields{"table": table, "rows": n}).Info("Backfilling query parameters")
+
+			if n < queryParamsBackfillBatchSize {
+				break
+			}
+		}
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// days monthly_traffic and events rows are kept for sites without their own setting, 0 keeps them forever
+var TrafficRetentionDays = envInt("TRAFFIC_RETENTION_DAYS", 0)
+var EventsRetentionDays = envInt("EVENTS_RETENTION_DAYS", 0)
+
+// how often expired rows are purged
+var RetentionInterval = envDuration("RETENTION_INTERVAL", time.Hour)
+
+// number of rows deleted per statement, small batches keep locks short
+var RetentionBatchSize = envInt("RETENTION_BATCH_SIZE", 5000)
+
+// only count and log the rows that would be purged
+var RetentionDryRun = envString("RETENTION_DRY_RUN", "false") == "true"
+
+// tables retention applies to
+const (
+	retentionTraffic = "traffic"
+	retentionEvents  = "events"
+)
+
+// quarantined events are kept as long as events
+var retentionTables = map[string][]string{
+	retentionTraffic: {"monthly_traffic"},
+	retentionEvents:  {"events", "quarantined_events"},
+}
+
+// retentionDays returns how many days rows of kind are kept for the site, 0 if they are kept forever
+func (s *site) retentionDays(kind string) int {
+	if kind == retentionTraffic {
+		if s.TrafficRetentionDays != nil {
+			return *s.TrafficRetentionDays
+		}
+
+		return TrafficRetentionDays
+	}
+
+	if s.EventsRetentionDays != nil {
+		return *s.EventsRetentionDays
+	}
+
+	return EventsRetentionDays
+}
+
+// purgeTable deletes rows of domain older than cutoff from table, a batch at a time, and returns how many were
+// deleted. In a dry run the rows are only counted.
+func purgeTable(db *sql.DB, table string, domain string, cutoff time.Time, dryRun bool) (int64, error) {
+	if dryRun {
+		var count int64
+		err := db.QueryRow("SELECT COUNT(*) FROM public."+table+" WHERE domain = $1 AND timestamp < $2", domain, cutoff).Scan(&count)
+
+		return count, err
+	}
+
+	query := "DELETE FROM public." + table + " WHERE ctid IN (SELECT ctid FROM public." + table + " WHERE domain = $1 AND timestamp < $2 LIMIT $3)"
+
+	var deleted int64 = 0
+
+	for {
+		res, err := db.Exec(query, domain, cutoff, RetentionBatchSize)
+
+		if err != nil {
+			return deleted, err
+		}
+
+		n, _ := res.RowsAffected()
+		deleted += n
+
+		if n < int64(RetentionBatchSize) {
+			return deleted, nil
+		}
+	}
+}
+
+// purgeExpired applies the retention settings of every site and returns the number of rows purged
+func purgeExpired(db *sql.DB, dryRun bool) (int64, error) {
+	var total int64 = 0
+
+	for _, s := range registry.list() {
+		for _, kind := range []string{retentionTraffic, retentionEvents} {
+			days := s.retentionDays(kind)
+
+			if days <= 0 {
+				continue
+			}
+
+			cutoff := time.Now().UTC().AddDate(0, 0, -days)
+
+			for _, table := range retentionTables[kind] {
+				n, err := purgeTable(db, table, s.Domain, cutoff, dryRun)
+				total += n
+
+				if err != nil {
+					return total, err
+				}
+
+				if n == 0 {
+					continue
+				}
+
+				fields := log.Fields{"domain": s.Domain, "table": table, "rows": n, "before": cutoff.Format(time.DateOnly)}
+
+				if dryRun {
+					log.WithFields(fields).Info("Would purge expired rows")
+				} else {
+					log.WithFields(fields).Info("Purged expired rows")
+				}
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// purgePeriodically runs purgeExpired every RETENTION_INTERVAL
+func purgePeriodically(db *sql.DB) {
+	for {
+		_, err := purgeExpired(db, RetentionDryRun)
+
+		if err != nil {
+			metricDbErrors.inc("retention")
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Error("Failed to purge expired rows")
+		}
+
+		time.Sleep(RetentionInterval)
+	}
+}
+
+// retentionSetting sets how many days rows of kind are kept for a site, nil resets it to the global default
+func retentionSetting(kind string, days *int) siteSetting {
+	if _, ok := retentionTables[kind]; !ok {
+		return siteSetting{err: fmt.Errorf("retention must be set for %s or %s", retentionTraffic, retentionEvents)}
+	}
+
+	if days != nil && *days < 0 {
+		return siteSetting{err: fmt.Errorf("retention can't be negative")}
+	}
+
+	return siteSetting{column: kind + "_retention_days", value: days}
+}
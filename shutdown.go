@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// max time to wait for in-flight requests and the pipeline to drain on shutdown
+var ShutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+var shuttingDown atomic.Bool
+
+// rejectDuringShutdown is a middleware for ingest endpoints that turns away new events once shutdown has started
+func rejectDuringShutdown(ctx iris.Context) {
+	if shuttingDown.Load() {
+		metricRejected.inc(rejectShutdown)
+		ctx.Header("Retry-After", strconv.Itoa(IngestRetryAfter))
+		ctx.StopWithStatus(iris.StatusServiceUnavailable)
+		return
+	}
+
+	ctx.Next()
+}
+
+// listenAndServe runs the app until SIGINT or SIGTERM is received or the server fails. It then stops accepting ingest
+// requests, waits for running requests to finish and for the writers to flush the pipeline, all within ShutdownTimeout.
+// The error the server failed with is returned once the pipeline is drained.
+func listenAndServe(app *iris.Application, addr string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listenErr := make(chan error, 1)
+
+	go func() {
+		listenErr <- app.Listen(addr, iris.WithoutInterruptHandler)
+	}()
+
+	var failed error
+
+	select {
+	case <-ctx.Done():
+	case err := <-listenErr:
+		if err != nil && !errors.Is(err, iris.ErrServerClosed) {
+			failed = err
+		}
+	}
+
+	stop()
+
+	log.WithFields(log.Fields{"timeout": ShutdownTimeout}).Info("Shutting down")
+	shuttingDown.Store(true)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	err := app.Shutdown(shutdownCtx)
+
+	if err != nil {
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Warn("Failed to shut down server gracefully")
+	}
+
+	drainPipeline(shutdownCtx)
+
+	return failed
+}
+
+// drainPipeline closes the pipeline and waits for the writers to finish or ctx to expire
+func drainPipeline(ctx context.Context) {
+	writtenBefore := writtenEvents.Load()
+	failedBefore := failedEvents.Load()
+
+	closePipeline()
+
+	done := make(chan struct{})
+
+	go func() {
+		writers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("Timed out waiting for the pipeline to drain")
+	}
+
+	log.WithFields(log.Fields{
+		"flushed":   writtenEvents.Load() - writtenBefore,
+		"failed":    failedEvents.Load() - failedBefore,
+		"abandoned": inFlightEvents.Load(),
+	}).Info("Pipeline drained")
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata"
+)
+
+// how often the site registry is reloaded from the database
+var SiteRefreshInterval = envDuration("SITE_REFRESH_INTERVAL", 30*time.Second)
+
+type site struct {
+	Domain               string          `json:"domain"`
+	Aliases              []string        `json:"aliases"`
+	Timezone             string          `json:"timezone"`
+	InternalTraffic      string          `json:"internal_traffic"`
+	VisitorIdMode        string          `json:"visitor_id_mode"`
+	IpPolicy             string          `json:"ip_policy"`
+	PrivacySignals       string          `json:"privacy_signals"`
+	SchemaMode           string          `json:"schema_mode"`
+	PathOptions          pathOptions     `json:"path_options"`
+	PathRules            []pathRule      `json:"path_rules"`
+	TrafficRetentionDays *int            `json:"traffic_retention_days"`
+	EventsRetentionDays  *int            `json:"events_retention_days"`
+	Exclusions           []exclusionRule `json:"exclusions"`
+
+	// event schemas by event name, listed separately since they can be large
+	Schemas map[string]*eventSchema `json:"-"`
+}
+
+// Hosts returns the canonical domain followed by all aliases
+func (s *site) Hosts() []string {
+	return append([]string{s.Domain}, s.Aliases...)
+}
+
+// siteRegistry is an in-memory copy of the sites table, kept up to date by reloading it periodically
+type siteRegistry struct {
+	mu    sync.RWMutex
+	sites map[string]*site
+	hosts map[string]*site
+}
+
+var registry = &siteRegistry{
+	sites: make(map[string]*site),
+	hosts: make(map[string]*site),
+}
+
+func loadSites(db *sql.DB) (map[string]*site, error) {
+	rows, err := db.Query("SELECT domain, timezone, internal_traffic, visitor_id_mode, ip_policy, privacy_signals, schema_mode, strip_index, strip_trailing_slash, lowercase_paths, traffic_retention_days, events_retention_days FROM public.sites ORDER BY domain")
+
+	if err != nil {
+		return nil, err
+	}
+
+	sites := make(map[string]*site)
+
+	for rows.Next() {
+		s := site{Aliases: make([]string, 0), Exclusions: make([]exclusionRule, 0), PathRules: make([]pathRule, 0), Schemas: make(map[string]*eventSchema)}
+		err := rows.Scan(&s.Domain, &s.Timezone, &s.InternalTraffic, &s.VisitorIdMode, &s.IpPolicy, &s.PrivacySignals, &s.SchemaMode, &s.PathOptions.StripIndex, &s.PathOptions.StripTrailingSlash, &s.PathOptions.LowercasePaths, &s.TrafficRetentionDays, &s.EventsRetentionDays)
+
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		sites[s.Domain] = &s
+	}
+
+	rows.Close()
+
+	rows, err = db.Query("SELECT alias, domain FROM public.site_aliases ORDER BY alias")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var alias, domain string
+		err := rows.Scan(&alias, &domain)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if s, ok := sites[domain]; ok {
+			s.Aliases = append(s.Aliases, alias)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	exclusions, err := loadExclusionRules(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range exclusions {
+		if s, ok := sites[r.Domain]; ok {
+			s.Exclusions = append(s.Exclusions, r)
+		}
+	}
+
+	pathRules, err := loadPathRules(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range pathRules {
+		if s, ok := sites[r.Domain]; ok {
+			s.PathRules = append(s.PathRules, r)
+		}
+	}
+
+	schemas, err := loadEventSchemas(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range schemas {
+		if s, ok := sites[schemas[i].Domain]; ok {
+			s.Schemas[schemas[i].EventName] = &schemas[i]
+		}
+	}
+
+	return sites, nil
+}
+
+func (r *siteRegistry) reload(db *sql.DB) error {
+	sites, err := loadSites(db)
+
+	if err != nil {
+		return err
+	}
+
+	hosts := make(map[string]*site)
+
+	for _, s := range sites {
+		for _, host := range s.Hosts() {
+			hosts[host] = s
+		}
+	}
+
+	r.mu.Lock()
+	r.sites = sites
+	r.hosts = hosts
+	r.mu.Unlock()
+
+	return nil
+}
+
+// refresh reloads the registry every SiteRefreshInterval
+func (r *siteRegistry) refresh(db *sql.DB) {
+	ticker := time.NewTicker(SiteRefreshInterval)
+
+	for range ticker.C {
+		err := r.reload(db)
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Error("Failed to reload sites")
+		}
+	}
+}
+
+// resolve maps a domain or alias to its site
+func (r *siteRegistry) resolve(domain string) (*site, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.hosts[normalizeDomain(domain)]
+	return s, ok
+}
+
+func (r *siteRegistry) list() []*site {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make([]*site, 0, len(r.sites))
+
+	for _, s := range r.sites {
+		result = append(result, s)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Domain < result[j].Domain
+	})
+
+	return result
+}
+
+// siteLocation returns the timezone of the site of domain, UTC for unknown sites
+func siteLocation(domain string) *time.Location {
+	if s, ok := registry.resolve(domain); ok {
+		if loc, err := time.LoadLocation(s.Timezone); err == nil {
+			return loc
+		}
+	}
+
+	return time.UTC
+}
+
+// siteHosts returns every host that belongs to the site of domain, used to recognize the site's own referrers
+func siteHosts(domain string) []string {
+	if s, ok := registry.resolve(domain); ok {
+		return s.Hosts()
+	}
+
+	return []string{domain}
+}
+
+// siteSetting is a change to columns of the sites table. Settings are made by the *Setting functions, which keep
+// the validation error instead of returning it so a list of settings is only written if all of them are valid.
+type siteSetting struct {
+	column string
+	value  interface{}
+	err    error
+}
+
+// updateSite writes settings of a site in a single statement, db is either the database or a transaction
+func updateSite(db execer, domain string, settings ...siteSetting) error {
+	if len(settings) == 0 {
+		return nil
+	}
+
+	assignments := make([]string, len(settings))
+	args := make([]interface{}, len(settings), len(settings)+1)
+
+	for i, setting := range settings {
+		if setting.err != nil {
+			return setting.err
+		}
+
+		assignments[i] = fmt.Sprintf("%s = $%d", setting.column, i+1)
+		args[i] = setting.value
+	}
+
+	args = append(args, domain)
+	res, err := db.Exec(fmt.Sprintf("UPDATE public.sites SET %s WHERE domain = $%d", strings.Join(assignments, ", "), len(args)), args...)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no site %s", domain)
+	}
+
+	return nil
+}
+
+// setSite writes settings of a site and reloads the registry
+func setSite(db *sql.DB, domain string, settings ...siteSetting) error {
+	err := updateSite(db, domain, settings...)
+
+	if err != nil {
+		return err
+	}
+
+	return registry.reload(db)
+}
+
+func timezoneSetting(timezone string) siteSetting {
+	_, err := time.LoadLocation(timezone)
+
+	if err != nil {
+		return siteSetting{err: fmt.Errorf("invalid timezone %s", timezone)}
+	}
+
+	return siteSetting{column: "timezone", value: timezone}
+}
+
+// createSite registers a site with its aliases and settings in one transaction, so a site is only
+// created if all of them are valid
+func createSite(db *sql.DB, domain string, aliases []string, settings ...siteSetting) error {
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// checked in the database, the registry can be behind by up to SiteRefreshInterval
+	var target string
+	err = tx.QueryRow("SELECT domain FROM public.site_aliases WHERE alias = $1", domain).Scan(&target)
+
+	if err == nil {
+		return fmt.Errorf("%s is an alias of %s", domain, target)
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO public.sites (domain) VALUES ($1)", domain)
+
+	if err != nil {
+		return err
+	}
+
+	for _, alias := range aliases {
+		err = insertSiteAlias(tx, domain, alias)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = updateSite(tx, domain, settings...)
+
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return err
+	}
+
+	return registry.reload(db)
+}
+
+func deleteSite(db *sql.DB, domain string) error {
+	res, err := db.Exec("DELETE FROM public.sites WHERE domain = $1", domain)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no site %s", domain)
+	}
+
+	return registry.reload(db)
+}
+
+// insertSiteAlias adds an alias unless it is registered as a site, db is either the database or a transaction
+func insertSiteAlias(db execer, domain string, alias string) error {
+	res, err := db.Exec("INSERT INTO public.site_aliases (alias, domain) SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM public.sites WHERE domain = $1)",
+		alias, domain)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s is already registered as a site", alias)
+	}
+
+	return nil
+}
+
+func addSiteAlias(db *sql.DB, domain string, alias string) error {
+	err := insertSiteAlias(db, domain, alias)
+
+	if err != nil {
+		return err
+	}
+
+	return registry.reload(db)
+}
+
+func removeSiteAlias(db *sql.DB, alias string) error {
+	res, err := db.Exec("DELETE FROM public.site_aliases WHERE alias = $1", alias)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no alias %s", alias)
+	}
+
+	return registry.reload(db)
+}
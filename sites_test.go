@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSiteRequestSettings(t *testing.T) {
+	days := 30
+	reset := -1
+	body := siteRequest{
+		Timezone:             "Europe/Berlin",
+		IpPolicy:             ipPolicyTruncate,
+		PathOptions:          &pathOptions{StripIndex: true},
+		TrafficRetentionDays: &days,
+		EventsRetentionDays:  &reset,
+	}
+
+	want := map[string]interface{}{
+		"timezone":               "Europe/Berlin",
+		"ip_policy":              ipPolicyTruncate,
+		"strip_index":            true,
+		"strip_trailing_slash":   false,
+		"lowercase_paths":        false,
+		"traffic_retention_days": &days,
+		"events_retention_days":  (*int)(nil),
+	}
+
+	settings := body.settings()
+
+	if len(settings) != len(want) {
+		t.Fatalf("got %d settings, want %d", len(settings), len(want))
+	}
+
+	for _, setting := range settings {
+		if setting.err != nil {
+			t.Fatalf("setting %s: %v", setting.column, setting.err)
+		}
+
+		if value, ok := want[setting.column]; !ok || value != setting.value {
+			t.Errorf("setting %s = %v, want %v", setting.column, setting.value, value)
+		}
+	}
+}
+
+func TestUpdateSiteRejectsInvalidSettings(t *testing.T) {
+	days := -1
+
+	tests := []struct {
+		name    string
+		setting siteSetting
+		err     string
+	}{
+		{"timezone", timezoneSetting("Mars/Olympus"), "invalid timezone"},
+		{"internal traffic", internalTrafficSetting("keep"), "internal traffic must be"},
+		{"visitor id mode", visitorIdModeSetting("forever"), "visitor id mode must be"},
+		{"ip policy", ipPolicySetting("hash"), "ip policy must be"},
+		{"privacy signals", privacySignalsSetting("honor"), "privacy signals must be"},
+		{"schema mode", schemaModeSetting("warn"), "schema mode must be"},
+		{"retention kind", retentionSetting("sessions", nil), "retention must be set for"},
+		{"negative retention", retentionSetting(retentionEvents, &days), "retention can't be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// an invalid setting is rejected before anything is written, so no database is needed
+			err := updateSite(nil, "example.com", timezoneSetting("UTC"), tt.setting)
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("updateSite() error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// withSites replaces the registry with sites for the duration of the test
+func withSites(t *testing.T, sites ...*site) {
+	registry.mu.Lock()
+	previousSites, previousHosts := registry.sites, registry.hosts
+	registry.sites = make(map[string]*site)
+	registry.hosts = make(map[string]*site)
+
+	for _, s := range sites {
+		registry.sites[s.Domain] = s
+
+		for _, host := range s.Hosts() {
+			registry.hosts[host] = s
+		}
+	}
+
+	registry.mu.Unlock()
+
+	t.Cleanup(func() {
+		registry.mu.Lock()
+		registry.sites, registry.hosts = previousSites, previousHosts
+		registry.mu.Unlock()
+	})
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// directory for the on-disk spool, the spool is disabled when this is empty
+var SpoolDir = os.Getenv("SPOOL_DIR")
+
+// number of events written to a spool segment before a new one is started
+var SpoolSegmentSize = envInt("SPOOL_SEGMENT_SIZE", 10000)
+
+// eventSpool is nil when the spool is disabled
+var eventSpool *spool
+
+type spoolRecord struct {
+	Request  IngestRequest `json:"request"`
+	Received time.Time     `json:"received"`
+}
+
+// spoolSegment is one append-only file in the spool. It is deleted once it is closed and every
+// event in it has been committed to the database or moved to a dead letter file.
+type spoolSegment struct {
+	path    string
+	pending int
+	closed  bool
+}
+
+// spool is a write-ahead log between ingest and the database writer. Every queued event is appended
+// to the current segment before it is put on the pipeline, and acknowledged once its batch is committed.
+// Segments that still exist on startup are replayed, so events are delivered at least once.
+type spool struct {
+	mu      sync.Mutex
+	dir     string
+	current *spoolSegment
+	file    *os.File
+	written int
+	stopped bool
+}
+
+func segmentName() string {
+	return fmt.Sprintf("%020d.spool", time.Now().UnixNano())
+}
+
+// openSpool opens the spool in dir and replays segments left over from a previous run onto the pipeline
+func openSpool(dir string) (*spool, error) {
+	err := os.MkdirAll(dir, 0o750)
+
+	if err != nil {
+		return nil, err
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(leftovers)
+
+	s := &spool{dir: dir}
+
+	err = s.rotate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	go s.replay(leftovers)
+
+	return s, nil
+}
+
+// rotate closes the current segment and starts a new one, must be called with the lock held. If the new segment
+// can't be created the spool has no current segment until a later rotate succeeds.
+func (s *spool) rotate() error {
+	if s.file != nil {
+		_ = s.file.Sync()
+		_ = s.file.Close()
+		s.current.closed = true
+		s.removeIfDone(s.current)
+	}
+
+	// nothing is appended to the closed segment, the next enqueue tries to start a new one
+	s.file = nil
+	s.current = nil
+
+	path := filepath.Join(s.dir, segmentName())
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+
+	if err != nil {
+		return err
+	}
+
+	s.file = file
+	s.current = &spoolSegment{path: path}
+	s.written = 0
+
+	return nil
+}
+
+func (s *spool) removeIfDone(segment *spoolSegment) {
+	if !segment.closed || segment.pending > 0 {
+		return
+	}
+
+	err := os.Remove(segment.path)
+
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "segment": segment.path}).Error("Failed to remove spool segment")
+	}
+}
+
+// enqueue appends the event to the spool and puts it on the pipeline. It returns false without writing
+// anything if the pipeline is full. Producers are serialized by the lock so the capacity check can't race.
+func (s *spool) enqueue(e queuedEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped || len(pipeline) >= cap(pipeline) {
+		return false, nil
+	}
+
+	if s.file == nil {
+		err := s.rotate()
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	line, err := json.Marshal(spoolRecord{Request: e.Request, Received: e.Received})
+
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.file.Write(append(line, '\n'))
+
+	if err != nil {
+		return false, err
+	}
+
+	s.current.pending++
+	s.written++
+	e.segment = s.current
+	pipeline <- e
+
+	if s.written >= SpoolSegmentSize {
+		err = s.rotate()
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Error("Failed to rotate spool segment")
+		}
+	}
+
+	return true, nil
+}
+
+// ack marks events as committed and deletes segments that have nothing left pending
+func (s *spool) ack(events []queuedEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.release(events)
+}
+
+// release marks events as no longer pending, must be called with the lock held
+func (s *spool) release(events []queuedEvent) {
+	for _, e := range events {
+		if e.segment == nil {
+			continue
+		}
+
+		e.segment.pending--
+		s.removeIfDone(e.segment)
+	}
+}
+
+// deadLetter moves events the writer gave up on out of their segments into a file in the dead subdirectory, so the
+// segments can be deleted instead of replaying their committed events on every start. Dead letter files use the
+// segment format, moving one back into the spool directory replays it on the next start.
+func (s *spool) deadLetter(events []queuedEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	spooled := make([]queuedEvent, 0, len(events))
+
+	for _, e := range events {
+		if e.segment != nil {
+			spooled = append(spooled, e)
+		}
+	}
+
+	if len(spooled) == 0 {
+		return
+	}
+
+	path := filepath.Join(s.dir, "dead", segmentName())
+	err := writeSegment(path, spooled)
+
+	if err != nil {
+		// the events stay pending and their segments are replayed on the next start
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "file": path}).Error("Failed to write dead letter file")
+		return
+	}
+
+	log.WithFields(log.Fields{"file": path, "events": len(spooled)}).Warn("Moved events to dead letter file")
+	s.release(spooled)
+}
+
+// writeSegment writes events to a new segment file and syncs it
+func writeSegment(path string, events []queuedEvent) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o750)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o640)
+
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+
+	for _, e := range events {
+		line, err := json.Marshal(spoolRecord{Request: e.Request, Received: e.Received})
+
+		if err == nil {
+			_, err = w.Write(append(line, '\n'))
+		}
+
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+
+	err = w.Flush()
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// retry puts events back on the pipeline after writing them failed for a reason other than the events themselves,
+// waiting for room if it is full. Events still pending when the spool is closed are replayed on the next start.
+func (s *spool) retry(events []queuedEvent) {
+	for _, e := range events {
+		if !s.push(e) {
+			return
+		}
+	}
+}
+
+// close stops replaying and appending. Anything not yet acknowledged stays on disk for the next start.
+func (s *spool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+
+	if s.file != nil {
+		_ = s.file.Sync()
+		_ = s.file.Close()
+		s.file = nil
+		s.current.closed = true
+		s.removeIfDone(s.current)
+	}
+}
+
+// replay reads segments from a previous run and puts their events back on the pipeline
+func (s *spool) replay(paths []string) {
+	for _, path := range paths {
+		records, err := readSegment(path)
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "segment": path}).Error("Failed to read spool segment")
+			continue
+		}
+
+		segment := &spoolSegment{path: path, pending: len(records), closed: true}
+
+		log.WithFields(log.Fields{"segment": path, "events": len(records)}).Info("Replaying spool segment")
+
+		if len(records) == 0 {
+			s.mu.Lock()
+			s.removeIfDone(segment)
+			s.mu.Unlock()
+			continue
+		}
+
+		for _, r := range records {
+			if !s.push(queuedEvent{Request: r.Request, Received: r.Received, segment: segment}) {
+				return
+			}
+		}
+	}
+}
+
+// push puts a replayed event on the pipeline, waiting for room if it is full. It returns false if the spool was closed.
+func (s *spool) push(e queuedEvent) bool {
+	for {
+		s.mu.Lock()
+
+		if s.stopped {
+			s.mu.Unlock()
+			return false
+		}
+
+		if len(pipeline) < cap(pipeline) {
+			pipeline <- e
+			inFlightEvents.Add(1)
+			s.mu.Unlock()
+			return true
+		}
+
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readSegment reads all records of a segment. A truncated last line, left by a crash in the
+// middle of a write, is skipped.
+func readSegment(path string) ([]spoolRecord, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	records := make([]spoolRecord, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var r spoolRecord
+		err := json.Unmarshal(scanner.Bytes(), &r)
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "segment": path}).Warn("Skipping invalid spool record")
+			continue
+		}
+
+		records = append(records, r)
+	}
+
+	return records, scanner.Err()
+}
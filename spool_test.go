@@ -0,0 +1,241 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestSpool opens a spool in a temp dir and closes it when the test ends
+func openTestSpool(t *testing.T, dir string) *spool {
+	s, err := openSpool(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.close()
+
+		// leave the shared pipeline empty for the next test
+		for len(pipeline) > 0 {
+			<-pipeline
+		}
+	})
+
+	return s
+}
+
+// receive takes n events off the pipeline
+func receive(t *testing.T, n int) []queuedEvent {
+	events := make([]queuedEvent, 0, n)
+	timeout := time.After(time.Second)
+
+	for len(events) < n {
+		select {
+		case e := <-pipeline:
+			events = append(events, e)
+		case <-timeout:
+			t.Fatalf("got %d events from the pipeline, want %d", len(events), n)
+		}
+	}
+
+	return events
+}
+
+func segments(t *testing.T, pattern string) []string {
+	paths, err := filepath.Glob(pattern)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return paths
+}
+
+func testEvent(path string) queuedEvent {
+	return queuedEvent{Request: IngestRequest{Domain: "example.com", EventName: "page_view", Path: path}, Received: time.Now().UTC()}
+}
+
+func enqueueEvents(t *testing.T, s *spool, paths ...string) []queuedEvent {
+	for _, path := range paths {
+		queued, err := s.enqueue(testEvent(path))
+
+		if err != nil || !queued {
+			t.Fatalf("enqueue() = %v, %v, want the event queued", queued, err)
+		}
+	}
+
+	return receive(t, len(paths))
+}
+
+func rotate(t *testing.T, s *spool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.rotate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolAppendAndAck(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir)
+
+	events := enqueueEvents(t, s, "/a", "/b")
+	segment := events[0].segment.path
+
+	records, err := readSegment(segment)
+
+	if err != nil || len(records) != 2 || records[1].Request.Path != "/b" {
+		t.Fatalf("readSegment() = %v, %v, want both events", records, err)
+	}
+
+	// the current segment is kept even once everything in it is acknowledged
+	s.ack(events)
+
+	if _, err := os.Stat(segment); err != nil {
+		t.Fatalf("current segment was removed: %v", err)
+	}
+
+	rotate(t, s)
+
+	if _, err := os.Stat(segment); !os.IsNotExist(err) {
+		t.Fatalf("acknowledged segment still exists after rotating: %v", err)
+	}
+}
+
+func TestSpoolKeepsSegmentsWithPendingEvents(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir)
+
+	events := enqueueEvents(t, s, "/a", "/b")
+	segment := events[0].segment.path
+	rotate(t, s)
+
+	s.ack(events[:1])
+
+	if _, err := os.Stat(segment); err != nil {
+		t.Fatalf("segment with a pending event was removed: %v", err)
+	}
+
+	s.ack(events[1:])
+
+	if _, err := os.Stat(segment); !os.IsNotExist(err) {
+		t.Fatalf("segment still exists after its last event was acknowledged: %v", err)
+	}
+}
+
+func TestSpoolRotatesAfterSegmentSize(t *testing.T) {
+	previous := SpoolSegmentSize
+	SpoolSegmentSize = 2
+	t.Cleanup(func() { SpoolSegmentSize = previous })
+
+	s := openTestSpool(t, t.TempDir())
+	events := enqueueEvents(t, s, "/a", "/b", "/c")
+
+	if events[0].segment != events[1].segment || events[1].segment == events[2].segment {
+		t.Fatalf("want the first two events in one segment and the third in the next")
+	}
+}
+
+func TestSpoolReplaysLeftoverSegments(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "00000000000000000001.spool")
+
+	err := writeSegment(leftover, []queuedEvent{testEvent("/a"), testEvent("/b")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of a write leaves a truncated last line
+	file, _ := os.OpenFile(leftover, os.O_WRONLY|os.O_APPEND, 0o640)
+	_, _ = file.WriteString(`{"request": {"dom`)
+	_ = file.Close()
+
+	s := openTestSpool(t, dir)
+	events := receive(t, 2)
+
+	if events[0].Request.Path != "/a" || events[1].Request.Path != "/b" || events[0].segment.path != leftover {
+		t.Fatalf("replayed %+v, want /a and /b from the leftover segment", events)
+	}
+
+	s.ack(events)
+
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("replayed segment still exists after it was acknowledged: %v", err)
+	}
+}
+
+func TestSpoolDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir)
+
+	events := enqueueEvents(t, s, "/a", "/b")
+	segment := events[0].segment.path
+	rotate(t, s)
+
+	s.deadLetter(events[:1])
+	s.ack(events[1:])
+
+	if _, err := os.Stat(segment); !os.IsNotExist(err) {
+		t.Fatalf("segment still exists after its events were dead lettered and acknowledged: %v", err)
+	}
+
+	dead := segments(t, filepath.Join(dir, "dead", "*.spool"))
+
+	if len(dead) != 1 {
+		t.Fatalf("got dead letter files %v, want one", dead)
+	}
+
+	records, err := readSegment(dead[0])
+
+	if err != nil || len(records) != 1 || records[0].Request.Path != "/a" {
+		t.Fatalf("dead letter file holds %v, %v, want the event given up on", records, err)
+	}
+}
+
+func TestSpoolRecoversFromFailedRotate(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir)
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	err := s.rotate()
+	s.mu.Unlock()
+
+	if err == nil {
+		t.Fatal("rotate() succeeded without a spool directory")
+	}
+
+	if queued, err := s.enqueue(testEvent("/a")); queued || err == nil {
+		t.Fatalf("enqueue() = %v, %v, want the spool error", queued, err)
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	events := enqueueEvents(t, s, "/b")
+
+	if len(segments(t, filepath.Join(dir, "*.spool"))) != 1 || events[0].segment == nil {
+		t.Fatalf("want the event appended to a new segment once the directory is back")
+	}
+}
+
+func TestSpoolRetry(t *testing.T) {
+	s := openTestSpool(t, t.TempDir())
+	events := enqueueEvents(t, s, "/a", "/b")
+
+	s.retry(events)
+	retried := receive(t, 2)
+
+	if retried[0].segment != events[0].segment || retried[1].Request.Path != "/b" {
+		t.Fatalf("retried %+v, want the same events in their segment", retried)
+	}
+}
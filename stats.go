@@ -9,11 +9,15 @@ import (
 	"math"
 	"net"
 	"net/url"
+	"slices"
 	"sort"
 	"strconv"
 	"time"
 )
 
+// page views and events are grouped per hour in the timezone of the site
+const hourKeyLayout = "2006-01-02 15"
+
 type Statistic struct {
 	Domain               string                         `json:"domain"`
 	StartTime            *time.Time                     `json:"start_time"`
@@ -23,32 +27,67 @@ type Statistic struct {
 	PageViewsPerHour     *map[string]*int32             `json:"page_views_per_hour"`
 	EventsPerNameAndHour *map[string]*map[string]*int32 `json:"events_per_name_and_hour"`
 	VisitorsPerCountry   *map[string]*int32             `json:"visitors_per_country"`
+	VisitorsPerBrowser   *map[string]*int32             `json:"visitors_per_browser"`
+	VisitorsPerOs        *map[string]*int32             `json:"visitors_per_os"`
+	VisitorsPerDevice    *map[string]*int32             `json:"visitors_per_device"`
 	RequestsPerIp        *[]requestsPerIp               `json:"requests_per_ip"`
 	Referrers            *map[string]*int32             `json:"referrers"`
+	PageViewsPerPath     *map[string]*int32             `json:"page_views_per_path"`
 	VisitorsPerUtmSource *map[string]*int32             `json:"visitors_per_utm_source"`
 	RevenuePerUtmSource  *map[string]float32            `json:"revenue_per_utm_source"`
 	RevenuePerReferrer   *map[string]float32            `json:"revenue_per_referrer"`
+	VisitorsPerChannel   *map[string]*int32             `json:"visitors_per_channel"`
+	RevenuePerChannel    *map[string]float32            `json:"revenue_per_channel"`
 	SubscriptionsStarted int                            `json:"subscriptions_started"`
 	OrdersCompleted      int                            `json:"orders_completed"`
 	TrialsStarted        int                            `json:"trials_started"`
 	AccountsCreated      int                            `json:"accounts_created"`
+	BotTraffic           *botTraffic                    `json:"bot_traffic,omitempty"`
+	PrivacySignals       *privacySignals                `json:"privacy_signals"`
+	PageViewsPerQuery    *map[string]*map[string]*int32 `json:"page_views_per_query,omitempty"`
+	// caveats of the numbers, such as visitor counts that can't be exact because of the visitor id mode
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// StatsOptions selects the optional parts of a Statistic
+type StatsOptions struct {
+	BotBreakdown bool
+	// query parameters to count page views per value of, every value of a multi-valued parameter is counted
+	QueryBreakdown []string
+}
+
+// privacySignals counts the events stored anonymized or dropped because of do not track, global privacy control or
+// denied consent
+type privacySignals struct {
+	Anonymized int `json:"anonymized"`
+	Dropped    int `json:"dropped"`
+}
+
+type botTraffic struct {
+	Events       int                `json:"events"`
+	PerReason    *map[string]*int32 `json:"per_reason"`
+	PerUserAgent *map[string]*int32 `json:"per_user_agent"`
 }
 
 type event struct {
 	//Id          int64
-	Domain      string
-	EventName   string
-	Duration    int64
-	Timestamp   time.Time
-	UserAgent   string
-	Referrer    *string
-	VisitorId   string
-	SessionId   string
-	Path        string
-	QueryParams *map[string]interface{}
-	Country     string
-	EventData   *map[string]interface{}
-	StatusCode  int16
+	Domain         string
+	EventName      string
+	Duration       int64
+	Timestamp      time.Time
+	UserAgent      string
+	Referrer       *string
+	VisitorId      string
+	SessionId      string
+	Path           string
+	NormalizedPath string
+	QueryParams    *map[string]interface{}
+	Country        string
+	EventData      *map[string]interface{}
+	StatusCode     int16
+	Browser        string
+	Os             string
+	DeviceType     string
 }
 
 type request struct {
@@ -63,6 +102,7 @@ type request struct {
 	StatusCode  int16
 	Ip          net.IP
 	Ips         *[]net.IP
+	Anonymized  bool
 }
 
 type requestsPerIp struct {
@@ -73,7 +113,7 @@ type requestsPerIp struct {
 }
 
 func getTotalPageViews(db *sql.DB, domain string, start *time.Time, end *time.Time) (int, error) {
-	var query = "SELECT COUNT(*) AS c FROM public.events WHERE event_name = 'page_view' AND domain = $1"
+	var query = "SELECT COUNT(*) AS c FROM public.events WHERE event_name = 'page_view' AND domain = $1 AND NOT is_bot AND NOT is_internal"
 
 	if start != nil {
 		query = query + " AND timestamp >= $2"
@@ -81,9 +121,9 @@ func getTotalPageViews(db *sql.DB, domain string, start *time.Time, end *time.Ti
 
 	if end != nil {
 		if start != nil {
-			query = query + " AND timestamp::date <= $3"
+			query = query + " AND timestamp < $3"
 		} else {
-			query = query + " AND timestamp::date <= $2"
+			query = query + " AND timestamp < $2"
 		}
 	}
 
@@ -120,17 +160,17 @@ func getTotalPageViews(db *sql.DB, domain string, start *time.Time, end *time.Ti
 }
 
 func getTotalVisitors(db *sql.DB, domain string, start *time.Time, end *time.Time) (int, error) {
-	var query = "SELECT COUNT(DISTINCT visitor_id) AS c FROM public.events WHERE event_name = 'page_view' AND domain = $1"
+	var query = "SELECT COUNT(DISTINCT visitor_id) AS c FROM public.events WHERE event_name = 'page_view' AND domain = $1 AND NOT is_bot AND NOT is_internal"
 
 	if start != nil {
-		query = query + " AND timestamp::date >= $2"
+		query = query + " AND timestamp >= $2"
 	}
 
 	if end != nil {
 		if start != nil {
-			query = query + " AND timestamp::date <= $3"
+			query = query + " AND timestamp < $3"
 		} else {
-			query = query + " AND timestamp::date <= $2"
+			query = query + " AND timestamp < $2"
 		}
 	}
 
@@ -167,17 +207,17 @@ func getTotalVisitors(db *sql.DB, domain string, start *time.Time, end *time.Tim
 }
 
 func countEvents(db *sql.DB, domain string, start *time.Time, end *time.Time) (int, error) {
-	var query = "SELECT COUNT(*) FROM public.events WHERE domain = $1"
+	var query = "SELECT COUNT(*) FROM public.events WHERE domain = $1 AND NOT is_bot AND NOT is_internal"
 
 	if start != nil {
-		query = query + " AND timestamp::date >= $2"
+		query = query + " AND timestamp >= $2"
 	}
 
 	if end != nil {
 		if start != nil {
-			query = query + " AND timestamp::date <= $3"
+			query = query + " AND timestamp < $3"
 		} else {
-			query = query + " AND timestamp::date <= $2"
+			query = query + " AND timestamp < $2"
 		}
 	}
 
@@ -223,19 +263,19 @@ func getAllEvents(db *sql.DB, c chan *event, domain string, start *time.Time, en
 	}
 
 	for i := 0; i <= int(pageCount); i++ {
-		var query = "SELECT domain, event_name, duration, timestamp, user_agent, referrer, path, session_id, visitor_id, query_params, country, event_data, status_code FROM public.events WHERE domain = $1"
+		var query = "SELECT domain, event_name, duration, timestamp, user_agent, referrer, path, COALESCE(normalized_path, path), session_id, visitor_id, query_params, country, event_data, status_code, browser, os, device_type FROM public.events WHERE domain = $1 AND NOT is_bot AND NOT is_internal"
 
 		if !lastStart.IsZero() {
 			query = query + " AND timestamp >= $2"
 		} else if start != nil {
-			query = query + " AND timestamp::date >= $2"
+			query = query + " AND timestamp >= $2"
 		}
 
 		if end != nil {
 			if !lastStart.IsZero() || start != nil {
-				query = query + " AND timestamp::date <= $3"
+				query = query + " AND timestamp < $3"
 			} else {
-				query = query + " AND timestamp::date <= $2"
+				query = query + " AND timestamp < $2"
 			}
 		}
 
@@ -265,9 +305,13 @@ func getAllEvents(db *sql.DB, c chan *event, domain string, start *time.Time, en
 			var queryJson sql.NullString
 			var eventJson sql.NullString
 			var sessionId sql.NullString
+			var visitorId sql.NullString
 			var duration sql.NullInt64
+			var browser sql.NullString
+			var operatingSystem sql.NullString
+			var deviceType sql.NullString
 
-			err := rows.Scan(&e.Domain, &e.EventName, &duration, &e.Timestamp, &e.UserAgent, &e.Referrer, &e.Path, &sessionId, &e.VisitorId, &queryJson, &e.Country, &eventJson, &e.StatusCode)
+			err := rows.Scan(&e.Domain, &e.EventName, &duration, &e.Timestamp, &e.UserAgent, &e.Referrer, &e.Path, &e.NormalizedPath, &sessionId, &visitorId, &queryJson, &e.Country, &eventJson, &e.StatusCode, &browser, &operatingSystem, &deviceType)
 
 			if err != nil {
 				log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Error("Failed to scan events")
@@ -284,6 +328,28 @@ func getAllEvents(db *sql.DB, c chan *event, domain string, start *time.Time, en
 				e.SessionId = sessionId.String
 			}
 
+			// empty for visitors that opted out of tracking
+			if visitorId.Valid {
+				e.VisitorId = visitorId.String
+			}
+
+			// rows from before user agents were parsed are reported as unknown until they are backfilled
+			e.Browser = "Unknown"
+			e.Os = "Unknown"
+			e.DeviceType = "Unknown"
+
+			if browser.Valid {
+				e.Browser = browser.String
+			}
+
+			if operatingSystem.Valid {
+				e.Os = operatingSystem.String
+			}
+
+			if deviceType.Valid {
+				e.DeviceType = deviceType.String
+			}
+
 			if //goland:noinspection GoDfaConstantCondition
 			queryJson.Valid {
 				q := make(map[string]interface{})
@@ -324,17 +390,17 @@ func getAllEvents(db *sql.DB, c chan *event, domain string, start *time.Time, en
 }
 
 func getRequests(db *sql.DB, domain string, start *time.Time, end *time.Time) (*[]request, error) {
-	var query = "SELECT domain, duration, timestamp, user_agent, referrer, path, query_params, country, status_code, ip, ips FROM public.monthly_traffic WHERE domain = $1"
+	var query = "SELECT domain, duration, timestamp, user_agent, referrer, path, query_params, country, status_code, ip, ips, ip_anonymized FROM public.monthly_traffic WHERE domain = $1 AND NOT is_bot AND NOT is_internal"
 
 	if start != nil {
-		query = query + " AND timestamp::date >= $2"
+		query = query + " AND timestamp >= $2"
 	}
 
 	if end != nil {
 		if start != nil {
-			query = query + " AND timestamp::date <= $3"
+			query = query + " AND timestamp < $3"
 		} else {
-			query = query + " AND timestamp::date <= $2"
+			query = query + " AND timestamp < $2"
 		}
 	}
 
@@ -364,16 +430,18 @@ func getRequests(db *sql.DB, domain string, start *time.Time, end *time.Time) (*
 		var e request
 		var queryJson sql.NullString
 		var duration sql.NullInt64
-		var ip string
+		var ip sql.NullString
 		ips := make([]string, 10)
 
-		err := rows.Scan(&e.Domain, &duration, &e.Timestamp, &e.UserAgent, &e.Referrer, &e.Path, &queryJson, &e.Country, &e.StatusCode, &ip, pq.Array(&ips))
+		err := rows.Scan(&e.Domain, &duration, &e.Timestamp, &e.UserAgent, &e.Referrer, &e.Path, &queryJson, &e.Country, &e.StatusCode, &ip, pq.Array(&ips), &e.Anonymized)
 
 		if err != nil {
 			return nil, err
 		}
 
-		e.Ip = net.ParseIP(ip)
+		if ip.Valid {
+			e.Ip = net.ParseIP(ip.String)
+		}
 
 		if duration.Valid {
 			e.Duration = duration.Int64
@@ -403,10 +471,23 @@ func getRequests(db *sql.DB, domain string, start *time.Time, end *time.Time) (*
 	return &result, nil
 }
 
+// groupRequestsPerIp counts requests per client ip. Requests stored without an ip are skipped and if any of them
+// were anonymized all addresses are grouped by their truncated prefix so full and truncated rows add up.
 func groupRequestsPerIp(requests *[]request) (*[]requestsPerIp, error) {
 	eventsPerPath := make(map[string]*requestsPerIp)
+	truncate := slices.ContainsFunc(*requests, func(e request) bool {
+		return e.Anonymized
+	})
 
 	for _, e := range *requests {
+		if e.Ip == nil {
+			continue
+		}
+
+		if truncate {
+			e.Ip = net.ParseIP(truncateIp(e.Ip.String()))
+		}
+
 		key := e.Ip.String()
 
 		_, ok := eventsPerPath[key]
@@ -458,7 +539,144 @@ func groupRequestsPerIp(requests *[]request) (*[]requestsPerIp, error) {
 	return &result, nil
 }
 
-func getOriginalReferringDomain(db *sql.DB, visitorId string, domain string) (string, error) {
+// closestDay is the utc day closest to the range bound in parameter n, drops are only counted per utc day so
+// a range in another timezone can't be matched exactly
+func closestDay(n int) string {
+	return fmt.Sprintf("date_trunc('day', $%d::timestamp + interval '12 hours')", n)
+}
+
+// getPrivacySignals counts the events anonymized and dropped because of privacy signals
+func getPrivacySignals(db *sql.DB, domain string, start *time.Time, end *time.Time) (*privacySignals, error) {
+	var anonymizedQuery = "SELECT COUNT(*) FROM public.events WHERE privacy_anonymized AND domain = $1 AND NOT is_bot AND NOT is_internal"
+	var droppedQuery = "SELECT COALESCE(SUM(events), 0) FROM public.privacy_drops WHERE domain = $1"
+
+	args := []interface{}{domain}
+
+	if start != nil {
+		args = append(args, start)
+		anonymizedQuery += fmt.Sprintf(" AND timestamp >= $%d", len(args))
+		droppedQuery += fmt.Sprintf(" AND day >= %s", closestDay(len(args)))
+	}
+
+	if end != nil {
+		args = append(args, end)
+		anonymizedQuery += fmt.Sprintf(" AND timestamp < $%d", len(args))
+		droppedQuery += fmt.Sprintf(" AND day < %s", closestDay(len(args)))
+	}
+
+	var result privacySignals
+	err := db.QueryRow(anonymizedQuery, args...).Scan(&result.Anonymized)
+
+	if err != nil {
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Error("Failed to count anonymized events")
+		return nil, err
+	}
+
+	err = db.QueryRow(droppedQuery, args...).Scan(&result.Dropped)
+
+	if err != nil {
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Error("Failed to count dropped events")
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// getBotTraffic counts the events classified as bots per reason and for the most common user agents
+func getBotTraffic(db *sql.DB, domain string, start *time.Time, end *time.Time) (*botTraffic, error) {
+	var query = "SELECT COALESCE(bot_reason, ''), user_agent, COUNT(*) FROM public.events WHERE is_bot AND domain = $1"
+
+	if start != nil {
+		query = query + " AND timestamp >= $2"
+	}
+
+	if end != nil {
+		if start != nil {
+			query = query + " AND timestamp < $3"
+		} else {
+			query = query + " AND timestamp < $2"
+		}
+	}
+
+	query += " GROUP BY bot_reason, user_agent"
+
+	var rows *sql.Rows
+	var err error
+
+	if start != nil && end != nil {
+		rows, err = db.Query(query, domain, start, end)
+	} else if start != nil {
+		rows, err = db.Query(query, domain, start)
+	} else if end != nil {
+		rows, err = db.Query(query, domain, end)
+	} else {
+		rows, err = db.Query(query, domain)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err)}).Error("Failed to query for bot traffic")
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	type kv struct {
+		Key   string
+		Value int32
+	}
+
+	var result botTraffic
+	perReason := make(map[string]*int32)
+	userAgents := make([]kv, 0)
+
+	for rows.Next() {
+		var reason, userAgent string
+		var count int32
+
+		err := rows.Scan(&reason, &userAgent, &count)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result.Events += int(count)
+
+		if _, ok := perReason[reason]; !ok {
+			var n int32 = 0
+			perReason[reason] = &n
+		}
+
+		*perReason[reason] += count
+		userAgents = append(userAgents, kv{userAgent, count})
+	}
+
+	sort.Slice(userAgents, func(i, j int) bool {
+		return userAgents[i].Value > userAgents[j].Value
+	})
+
+	perUserAgent := make(map[string]*int32)
+
+	for i, v := range userAgents {
+		if i == 20 {
+			break
+		}
+
+		// the same user agent can be counted under several reasons
+		if p, ok := perUserAgent[v.Key]; ok {
+			*p += v.Value
+		} else {
+			count := v.Value
+			perUserAgent[v.Key] = &count
+		}
+	}
+
+	result.PerReason = &perReason
+	result.PerUserAgent = &perUserAgent
+
+	return &result, rows.Err()
+}
+
+func getOriginalReferringDomain(db *sql.DB, visitorId string, hosts []string) (string, error) {
 	var query = "SELECT referrer FROM public.events WHERE visitor_id = $1 ORDER BY timestamp ASC LIMIT 1"
 	rows, err := db.Query(query, visitorId)
 	var result = ""
@@ -482,7 +700,7 @@ func getOriginalReferringDomain(db *sql.DB, visitorId string, domain string) (st
 
 		u, err := url.Parse(referrer.String)
 		if err == nil {
-			if u.Host != domain && u.Host != "www."+domain {
+			if !slices.Contains(hosts, u.Host) {
 				result = u.Host
 			}
 		}
@@ -491,6 +709,42 @@ func getOriginalReferringDomain(db *sql.DB, visitorId string, domain string) (st
 	return result, nil
 }
 
+// queryParamValues returns all values of a query parameter of an event. Parameters are stored as arrays of values,
+// a single string is accepted too in case a row wasn't converted.
+func queryParamValues(params *map[string]interface{}, key string) []string {
+	if params == nil {
+		return nil
+	}
+
+	switch v := (*params)[key].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+
+		return values
+	}
+
+	return nil
+}
+
+// queryParam returns the first value of a query parameter of an event
+func queryParam(params *map[string]interface{}, key string) (string, bool) {
+	values := queryParamValues(params, key)
+
+	if len(values) == 0 {
+		return "", false
+	}
+
+	return values[0], true
+}
+
 func increment(counts map[string]*int32, key string) {
 	if p, ok := counts[key]; ok {
 		*p++
@@ -501,14 +755,53 @@ func increment(counts map[string]*int32, key string) {
 	counts[key] = &n
 }
 
-func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Statistic, error) {
+// statsRange returns the utc instant the start day begins at and the one the end day ends at, the end is exclusive
+func statsRange(loc *time.Location, start *time.Time, end *time.Time) (*time.Time, *time.Time) {
+	var from, until *time.Time
+
+	if start != nil {
+		t := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc).UTC()
+		from = &t
+	}
+
+	if end != nil {
+		t := time.Date(end.Year(), end.Month(), end.Day()+1, 0, 0, 0, 0, loc).UTC()
+		until = &t
+	}
+
+	return from, until
+}
+
+// warningDailySaltVisitors explains visitor counts of ranges longer than a day on sites in daily_salt mode
+const warningDailySaltVisitors = "visitor ids change every day in daily_salt mode, visitors returning on several days of the range are counted once per day"
+
+// spansSaltDays reports whether the range from start to the exclusive end covers more than one utc day, the
+// visitor id salt changes at utc midnight
+func spansSaltDays(start *time.Time, end *time.Time) bool {
+	if start == nil || end == nil {
+		return true
+	}
+
+	return start.UTC().Format(time.DateOnly) != end.Add(-time.Nanosecond).UTC().Format(time.DateOnly)
+}
+
+func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time, options StatsOptions) (*Statistic, error) {
 	var readChannel = make(chan *event, 100000)
 
 	var stats Statistic
 	stats.Domain = domain
+	hosts := siteHosts(domain)
 	stats.StartTime = start
 	stats.EndTime = end
 
+	// start and end are days in the timezone of the site, the queries use the utc instants they begin and end at
+	loc := siteLocation(domain)
+	start, end = statsRange(loc, start, end)
+
+	if s, ok := registry.resolve(domain); ok && s.VisitorIdMode == visitorIdDailySalt && spansSaltDays(start, end) {
+		stats.Warnings = append(stats.Warnings, warningDailySaltVisitors)
+	}
+
 	tpv, err := getTotalPageViews(db, domain, start, end)
 	if err != nil {
 		return nil, err
@@ -525,11 +818,24 @@ func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Sta
 
 	pageViewsPerHour := make(map[string]*int32)
 	eventsPerNameAndHour := make(map[string]*map[string]*int32)
+	pageViewsPerQuery := make(map[string]*map[string]*int32)
+	pageViewsPerPath := make(map[string]*int32)
+
+	for _, key := range options.QueryBreakdown {
+		var x = make(map[string]*int32)
+		pageViewsPerQuery[key] = &x
+	}
 	visitorsPerCountry := make(map[string]*int32)
+	visitorsPerBrowser := make(map[string]*int32)
+	visitorsPerOs := make(map[string]*int32)
+	visitorsPerDevice := make(map[string]*int32)
 	pageViewsPerReferrer := make(map[string]*int32)
 	visitorsPerUtmSource := make(map[string]*int32)
 	revenuePerUtmSource := make(map[string]float32)
 	revenuePerReferrer := make(map[string]float32)
+	visitorsPerChannel := make(map[string]*int32)
+	revenuePerChannel := make(map[string]float32)
+	visitorChannels := make(map[string]string)
 	visitorIds := make(map[string]bool)
 	utmSourceVisitors := make(map[string]bool)
 	var ordersCompleted = 0
@@ -541,13 +847,29 @@ func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Sta
 		if e.EventName == "page_view" {
 
 			// group page views
-			key := e.Timestamp.String()[:13]
+			key := e.Timestamp.In(loc).Format(hourKeyLayout)
 			increment(pageViewsPerHour, key)
 
+			// group page views per normalized path, rows stored before paths were normalized use the raw path
+			increment(pageViewsPerPath, e.NormalizedPath)
+
+			// group page views per value of the requested query parameters
+			for key, p := range pageViewsPerQuery {
+				for _, value := range queryParamValues(e.QueryParams, key) {
+					increment(*p, value)
+				}
+			}
+
+			// page views of visitors that opted out can't be attributed to a visitor
+			anonymous := e.VisitorId == ""
+
 			// group visitors per country
 			_, exists := visitorIds[e.VisitorId]
-			if !exists {
+			if !exists && !anonymous {
 				increment(visitorsPerCountry, e.Country)
+				increment(visitorsPerBrowser, e.Browser)
+				increment(visitorsPerOs, e.Os)
+				increment(visitorsPerDevice, e.DeviceType)
 				visitorIds[e.VisitorId] = true
 			}
 
@@ -560,7 +882,7 @@ func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Sta
 					continue
 				}
 
-				if u.Host != domain {
+				if !slices.Contains(hosts, u.Host) {
 					referrer = u.Host
 				}
 			}
@@ -569,10 +891,21 @@ func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Sta
 				increment(pageViewsPerReferrer, referrer)
 			}
 
+			// group visitors per channel, a visitor belongs to the channel of its first page view in the range
+			channel, ok := visitorChannels[e.VisitorId]
+			if !ok {
+				channel = classifyChannel(referrer, e.QueryParams)
+
+				if !anonymous {
+					visitorChannels[e.VisitorId] = channel
+					increment(visitorsPerChannel, channel)
+				}
+			}
+
 			// group page views per utm source
-			_, ok := utmSourceVisitors[e.VisitorId]
-			if !ok && e.QueryParams != nil {
-				key, ok := (*e.QueryParams)["utm_source"].(string)
+			_, ok = utmSourceVisitors[e.VisitorId]
+			if !ok && !anonymous && e.QueryParams != nil {
+				key, ok := queryParam(e.QueryParams, "utm_source")
 
 				if ok {
 					increment(visitorsPerUtmSource, key)
@@ -582,14 +915,16 @@ func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Sta
 
 			// revenue per utm source and referrer
 			if e.QueryParams != nil {
-				sale, ok := (*e.QueryParams)["sale_total"].(string)
+				sale, ok := queryParam(e.QueryParams, "sale_total")
 
 				if ok {
 					f, err := strconv.ParseFloat(sale, 32)
 
 					if err == nil {
 
-						source, ok := (*e.QueryParams)["utm_source"].(string)
+						revenuePerChannel[channel] += float32(f)
+
+						source, ok := queryParam(e.QueryParams, "utm_source")
 
 						if ok {
 
@@ -602,17 +937,20 @@ func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Sta
 							revenuePerUtmSource[source] += float32(f)
 						}
 
-						referrer, err := getOriginalReferringDomain(db, e.VisitorId, domain)
+						// the original referrer of a visitor that opted out can't be looked up
+						if !anonymous {
+							referrer, err := getOriginalReferringDomain(db, e.VisitorId, hosts)
 
-						if err == nil {
-							if len(referrer) > 0 {
-								_, rok := revenuePerReferrer[referrer]
+							if err == nil {
+								if len(referrer) > 0 {
+									_, rok := revenuePerReferrer[referrer]
 
-								if !rok {
-									revenuePerReferrer[referrer] = 0
-								}
+									if !rok {
+										revenuePerReferrer[referrer] = 0
+									}
 
-								revenuePerReferrer[referrer] += float32(f)
+									revenuePerReferrer[referrer] += float32(f)
+								}
 							}
 						}
 					}
@@ -627,7 +965,7 @@ func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Sta
 				eventsPerNameAndHour[e.EventName] = p
 			}
 
-			key := e.Timestamp.String()[:13]
+			key := e.Timestamp.In(loc).Format(hourKeyLayout)
 			increment(*p, key)
 		}
 
@@ -644,11 +982,21 @@ func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Sta
 
 	stats.PageViewsPerHour = &pageViewsPerHour
 	stats.EventsPerNameAndHour = &eventsPerNameAndHour
+
+	if len(options.QueryBreakdown) > 0 {
+		stats.PageViewsPerQuery = &pageViewsPerQuery
+	}
 	stats.VisitorsPerCountry = &visitorsPerCountry
+	stats.VisitorsPerBrowser = &visitorsPerBrowser
+	stats.VisitorsPerOs = &visitorsPerOs
+	stats.VisitorsPerDevice = &visitorsPerDevice
 	stats.Referrers = &pageViewsPerReferrer
+	stats.PageViewsPerPath = &pageViewsPerPath
 	stats.VisitorsPerUtmSource = &visitorsPerUtmSource
 	stats.RevenuePerUtmSource = &revenuePerUtmSource
 	stats.RevenuePerReferrer = &revenuePerReferrer
+	stats.VisitorsPerChannel = &visitorsPerChannel
+	stats.RevenuePerChannel = &revenuePerChannel
 	stats.OrdersCompleted = ordersCompleted
 	stats.SubscriptionsStarted = subscriptionsStarted
 	stats.TrialsStarted = trialsStarted
@@ -669,5 +1017,23 @@ func GetStats(db *sql.DB, domain string, start *time.Time, end *time.Time) (*Sta
 
 	stats.RequestsPerIp = rpi
 
+	if options.BotBreakdown {
+		bt, err := getBotTraffic(db, domain, start, end)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stats.BotTraffic = bt
+	}
+
+	ps, err := getPrivacySignals(db, domain, start, end)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stats.PrivacySignals = ps
+
 	return &stats, nil
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsRange(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	newYork, _ := time.LoadLocation("America/New_York")
+
+	day := func(s string) *time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return &d
+	}
+
+	tests := []struct {
+		name      string
+		loc       *time.Location
+		start     *time.Time
+		end       *time.Time
+		wantFrom  string
+		wantUntil string
+	}{
+		{"utc", time.UTC, day("2024-01-01"), day("2024-01-31"), "2024-01-01T00:00:00Z", "2024-02-01T00:00:00Z"},
+		{"east of utc", berlin, day("2024-01-01"), day("2024-01-31"), "2023-12-31T23:00:00Z", "2024-01-31T23:00:00Z"},
+		{"west of utc", newYork, day("2024-01-01"), day("2024-01-31"), "2024-01-01T05:00:00Z", "2024-02-01T05:00:00Z"},
+		{"daylight saving time", berlin, day("2024-07-01"), day("2024-07-01"), "2024-06-30T22:00:00Z", "2024-07-01T22:00:00Z"},
+		{"open start", berlin, nil, day("2024-01-31"), "", "2024-01-31T23:00:00Z"},
+		{"open end", berlin, day("2024-01-01"), nil, "2023-12-31T23:00:00Z", ""},
+	}
+
+	format := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+
+		return t.Format(time.RFC3339)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, until := statsRange(tt.loc, tt.start, tt.end)
+
+			if format(from) != tt.wantFrom || format(until) != tt.wantUntil {
+				t.Errorf("statsRange() = %s, %s, want %s, %s", format(from), format(until), tt.wantFrom, tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestSpansSaltDays(t *testing.T) {
+	at := func(s string) *time.Time {
+		d, _ := time.Parse(time.RFC3339, s)
+		return &d
+	}
+
+	tests := []struct {
+		name  string
+		start *time.Time
+		end   *time.Time
+		want  bool
+	}{
+		{"one utc day", at("2024-01-01T00:00:00Z"), at("2024-01-02T00:00:00Z"), false},
+		{"two utc days", at("2024-01-01T00:00:00Z"), at("2024-01-03T00:00:00Z"), true},
+		{"one day in another timezone", at("2023-12-31T23:00:00Z"), at("2024-01-01T23:00:00Z"), true},
+		{"open start", nil, at("2024-01-02T00:00:00Z"), true},
+		{"open end", at("2024-01-01T00:00:00Z"), nil, true},
+	}
+
+	for _, tt := range tests {
+		if got := spansSaltDays(tt.start, tt.end); got != tt.want {
+			t.Errorf("%s: spansSaltDays() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// audit log actions
+const (
+	auditExport = "export"
+	auditErase  = "erase"
+)
+
+// subject identifies the rows of a data subject by ip or visitor id, optionally narrowed down by user agent and site.
+// A user agent alone is shared by every visitor on the same browser build, so it never identifies a subject by itself.
+// Traffic rows are matched by ip and user agent, events by visitor id, which is derived from the ip and user agents
+// the same way it is at ingest. Ids hashed with a salt of a previous day can't be derived any more.
+type subject struct {
+	Domain    string `json:"domain,omitempty"`
+	Ip        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	VisitorId string `json:"visitor_id,omitempty"`
+}
+
+type subjectData struct {
+	Subject subject           `json:"subject"`
+	Events  []json.RawMessage `json:"events"`
+	Traffic []json.RawMessage `json:"traffic"`
+}
+
+type subjectErasure struct {
+	Subject subject `json:"subject"`
+	Events  int64   `json:"events"`
+	Traffic int64   `json:"traffic"`
+}
+
+func (s *subject) validate() error {
+	s.Domain = normalizeDomain(s.Domain)
+	s.Ip = strings.TrimSpace(s.Ip)
+	s.VisitorId = strings.TrimSpace(s.VisitorId)
+
+	if s.Ip == "" && s.VisitorId == "" {
+		return fmt.Errorf("an ip or visitor id is required, a user agent only narrows them down")
+	}
+
+	if s.Ip != "" && net.ParseIP(s.Ip) == nil {
+		return fmt.Errorf("invalid ip %s", s.Ip)
+	}
+
+	if s.Domain != "" {
+		site, ok := registry.resolve(s.Domain)
+
+		if !ok {
+			return fmt.Errorf("no site %s", s.Domain)
+		}
+
+		s.Domain = site.Domain
+	}
+
+	return nil
+}
+
+// whereClause joins conditions that each use a single argument, referred to as $n, into a where clause
+func whereClause(conditions []string) string {
+	for i := range conditions {
+		conditions[i] = strings.ReplaceAll(conditions[i], "$n", "$"+strconv.Itoa(i+1))
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// trafficFilter matches monthly_traffic rows, ok is false if the subject has no ip to match them by
+func (s *subject) trafficFilter() (string, []interface{}, bool) {
+	if s.Ip == "" {
+		return "", nil, false
+	}
+
+	conditions := []string{"(ip = $n::inet OR $n::inet = ANY(ips))"}
+	args := []interface{}{s.Ip}
+
+	if s.UserAgent != "" {
+		conditions = append(conditions, "user_agent = $n")
+		args = append(args, s.UserAgent)
+	}
+
+	if s.Domain != "" {
+		conditions = append(conditions, "domain = $n")
+		args = append(args, s.Domain)
+	}
+
+	return whereClause(conditions), args, true
+}
+
+// visitorIds returns the visitor ids the subject may have been stored under: the given id and, for an ip, the stable
+// and today's salted hash of it combined with the user agent, or every user agent seen with the ip, on every site
+func (s *subject) visitorIds(db *sql.DB) ([]string, error) {
+	ids := make([]string, 0)
+
+	if s.VisitorId != "" {
+		ids = append(ids, s.VisitorId)
+	}
+
+	if s.Ip == "" {
+		return ids, nil
+	}
+
+	userAgents := make([]string, 0)
+
+	if s.UserAgent != "" {
+		userAgents = append(userAgents, s.UserAgent)
+	} else {
+		clause, args, _ := s.trafficFilter()
+		rows, err := db.Query("SELECT DISTINCT user_agent FROM public.monthly_traffic"+clause, args...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var ua string
+			err := rows.Scan(&ua)
+
+			if err != nil {
+				return nil, err
+			}
+
+			userAgents = append(userAgents, ua)
+		}
+
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	salt, err := visitorSalts.current(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	domains := []string{s.Domain}
+
+	if s.Domain == "" {
+		domains = make([]string, 0)
+
+		for _, site := range registry.list() {
+			domains = append(domains, site.Domain)
+		}
+	}
+
+	for _, ua := range userAgents {
+		ids = append(ids, hashVisitor(visitorIdStable, nil, "", s.Ip, ua))
+
+		for _, domain := range domains {
+			ids = append(ids, hashVisitor(visitorIdDailySalt, salt, domain, s.Ip, ua))
+		}
+	}
+
+	return ids, nil
+}
+
+// eventsFilter matches events rows, ok is false if the subject can't be linked to any
+func (s *subject) eventsFilter(db *sql.DB) (string, []interface{}, bool, error) {
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	ids, err := s.visitorIds(db)
+
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	if len(ids) == 0 {
+		return "", nil, false, nil
+	}
+
+	conditions = append(conditions, "visitor_id = ANY($n)")
+	args = append(args, pq.Array(ids))
+
+	if s.Domain != "" {
+		conditions = append(conditions, "domain = $n")
+		args = append(args, s.Domain)
+	}
+
+	return whereClause(conditions), args, true, nil
+}
+
+func queryJsonRows(db *sql.DB, table string, clause string, args []interface{}) ([]json.RawMessage, error) {
+	rows, err := db.Query("SELECT row_to_json(t) FROM public."+table+" t"+clause+" ORDER BY timestamp", args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]json.RawMessage, 0)
+
+	for rows.Next() {
+		var row []byte
+		err := rows.Scan(&row)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// writeAuditLog records an action on a subject, db is either the database or the transaction the action ran in
+func writeAuditLog(db execer, actor string, action string, s subject, events int64, traffic int64) error {
+	subjectJson, err := json.Marshal(s)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO public.audit_log (actor, action, subject, events, traffic) VALUES ($1, $2, $3, $4, $5)",
+		actor, action, string(subjectJson), events, traffic)
+
+	return err
+}
+
+// exportSubject returns every stored row of the subject and records the export in the audit log
+func exportSubject(db *sql.DB, actor string, s subject) (*subjectData, error) {
+	err := s.validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	data := subjectData{Subject: s, Events: make([]json.RawMessage, 0), Traffic: make([]json.RawMessage, 0)}
+
+	if clause, args, ok := s.trafficFilter(); ok {
+		data.Traffic, err = queryJsonRows(db, "monthly_traffic", clause, args)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	clause, args, ok, err := s.eventsFilter(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		data.Events, err = queryJsonRows(db, "events", clause, args)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = writeAuditLog(db, actor, auditExport, s, int64(len(data.Events)), int64(len(data.Traffic)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+// eraseSubject deletes every stored row of the subject and records the erasure in the audit log, all in one transaction
+func eraseSubject(db *sql.DB, actor string, s subject) (*subjectErasure, error) {
+	err := s.validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// visitor ids are derived from the traffic rows, so before they are deleted
+	eventsClause, eventsArgs, eventsOk, err := s.eventsFilter(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	erasure := subjectErasure{Subject: s}
+
+	if eventsOk {
+		res, err := tx.Exec("DELETE FROM public.events"+eventsClause, eventsArgs...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		erasure.Events, _ = res.RowsAffected()
+	}
+
+	if clause, args, ok := s.trafficFilter(); ok {
+		res, err := tx.Exec("DELETE FROM public.monthly_traffic"+clause, args...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		erasure.Traffic, _ = res.RowsAffected()
+	}
+
+	err = writeAuditLog(tx, actor, auditErase, s, erasure.Events, erasure.Traffic)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &erasure, tx.Commit()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+)
+
+const (
+	deviceDesktop = "desktop"
+	deviceMobile  = "mobile"
+	deviceTablet  = "tablet"
+)
+
+type userAgentInfo struct {
+	Browser        string
+	BrowserVersion string
+	Os             string
+	OsVersion      string
+	DeviceType     string
+}
+
+type userAgentRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// checked in order, browsers built on chrome or safari must come before them since they include their tokens too
+var browserRules = []userAgentRule{
+	{"Edge", regexp.MustCompile(`(?:Edg|Edge|EdgA|EdgiOS)/(\d+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|OPiOS|Opera)/(\d+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/(\d+)`)},
+	{"Yandex", regexp.MustCompile(`YaBrowser/(\d+)`)},
+	{"Vivaldi", regexp.MustCompile(`Vivaldi/(\d+)`)},
+	{"UC Browser", regexp.MustCompile(`UCBrowser/(\d+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/(\d+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/(\d+)`)},
+	{"Safari", regexp.MustCompile(`Version/(\d+)[\d.]* (?:Mobile/\S+ )?Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)(\d+)`)},
+}
+
+var osRules = []userAgentRule{
+	{"Windows", regexp.MustCompile(`Windows NT (\d+\.\d+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|iPad|iPod).*? OS (\d+(?:_\d+)?)`)},
+	{"Android", regexp.MustCompile(`Android (\d+(?:\.\d+)?)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS \S+ (\d+)`)},
+	{"macOS", regexp.MustCompile(`Mac OS X (\d+(?:[_.]\d+)?)`)},
+	{"Linux", regexp.MustCompile(`Linux()`)},
+}
+
+// marketing names of windows nt versions
+var windowsVersions = map[string]string{
+	"10.0": "10",
+	"6.3":  "8.1",
+	"6.2":  "8",
+	"6.1":  "7",
+	"6.0":  "Vista",
+	"5.1":  "XP",
+}
+
+func matchRules(rules []userAgentRule, userAgent string) (string, string) {
+	for _, rule := range rules {
+		if m := rule.pattern.FindStringSubmatch(userAgent); m != nil {
+			return rule.name, m[1]
+		}
+	}
+
+	return "Other", ""
+}
+
+// parseUserAgent extracts browser, os and device class from a user agent. Unknown browsers and
+// operating systems are reported as "Other" and anything not recognized as mobile or tablet as desktop.
+func parseUserAgent(userAgent string) userAgentInfo {
+	var info userAgentInfo
+
+	info.Browser, info.BrowserVersion = matchRules(browserRules, userAgent)
+	info.Os, info.OsVersion = matchRules(osRules, userAgent)
+
+	switch info.Os {
+	case "Windows":
+		if v, ok := windowsVersions[info.OsVersion]; ok {
+			info.OsVersion = v
+		}
+	case "iOS", "macOS":
+		info.OsVersion = strings.ReplaceAll(info.OsVersion, "_", ".")
+	}
+
+	switch {
+	case strings.Contains(userAgent, "iPad") || strings.Contains(userAgent, "Tablet") ||
+		(info.Os == "Android" && !strings.Contains(userAgent, "Mobile")):
+		info.DeviceType = deviceTablet
+	case strings.Contains(userAgent, "Mobi") || strings.Contains(userAgent, "iPhone") || strings.Contains(userAgent, "iPod"):
+		info.DeviceType = deviceMobile
+	default:
+		info.DeviceType = deviceDesktop
+	}
+
+	return info
+}
+
+// number of distinct user agents the backfill updates per statement
+const userAgentBackfillBatchSize = 1000
+
+// backfillUserAgents parses the user agent of rows stored before user agents were parsed at ingest.
+// Rows are updated in batches of distinct user agents to keep every update small.
+func backfillUserAgents(db *sql.DB) (int64, error) {
+	var updated int64 = 0
+
+	for _, table := range []string{"events", "monthly_traffic"} {
+		rows, err := db.Query("SELECT DISTINCT user_agent FROM public." + table + " WHERE browser IS NULL")
+
+		if err != nil {
+			return updated, err
+		}
+
+		userAgents := make([]string, 0)
+
+		for rows.Next() {
+			var ua string
+			err := rows.Scan(&ua)
+
+			if err != nil {
+				rows.Close()
+				return updated, err
+			}
+
+			userAgents = append(userAgents, ua)
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return updated, err
+		}
+
+		for start := 0; start < len(userAgents); start += userAgentBackfillBatchSize {
+			batch := userAgents[start:min(start+userAgentBackfillBatchSize, len(userAgents))]
+			n, err := updateUserAgents(db, table, batch)
+			updated += n
+
+			if err != nil {
+				return updated, err
+			}
+
+			log.WithFields(log.Fields{"table": table, "userAgents": start + len(batch), "of": len(userAgents)}).Info("Backfilling user agents")
+		}
+	}
+
+	return updated, nil
+}
+
+// updateUserAgents sets the parsed dimensions of the unparsed rows of every user agent in a single statement
+func updateUserAgents(db *sql.DB, table string, userAgents []string) (int64, error) {
+	browsers := make([]string, len(userAgents))
+	browserVersions := make([]string, len(userAgents))
+	oses := make([]string, len(userAgents))
+	osVersions := make([]string, len(userAgents))
+	deviceTypes := make([]string, len(userAgents))
+
+	for i, ua := range userAgents {
+		info := parseUserAgent(ua)
+		browsers[i] = info.Browser
+		browserVersions[i] = info.BrowserVersion
+		oses[i] = info.Os
+		osVersions[i] = info.OsVersion
+		deviceTypes[i] = info.DeviceType
+	}
+
+	res, err := db.Exec("UPDATE public."+table+" t SET browser = m.browser, browser_version = NULLIF(m.browser_version, ''), "+
+		"os = m.os, os_version = NULLIF(m.os_version, ''), device_type = m.device_type "+
+		"FROM unnest($1::varchar[], $2::varchar[], $3::varchar[], $4::varchar[], $5::varchar[], $6::varchar[]) "+
+		"AS m(user_agent, browser, browser_version, os, os_version, device_type) "+
+		"WHERE t.user_agent = m.user_agent AND t.browser IS NULL",
+		pq.Array(userAgents), pq.Array(browsers), pq.Array(browserVersions), pq.Array(oses), pq.Array(osVersions), pq.Array(deviceTypes))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
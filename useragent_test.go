@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      userAgentInfo
+	}{
+		{"chrome on windows", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			userAgentInfo{"Chrome", "124", "Windows", "10", deviceDesktop}},
+		{"edge before chrome", "Mozilla/5.0 (Windows NT 6.1; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.2478.51",
+			userAgentInfo{"Edge", "124", "Windows", "7", deviceDesktop}},
+		{"firefox on linux", "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+			userAgentInfo{"Firefox", "125", "Linux", "", deviceDesktop}},
+		{"safari on macos", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4.1 Safari/605.1.15",
+			userAgentInfo{"Safari", "17", "macOS", "10.15", deviceDesktop}},
+		{"safari on iphone", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+			userAgentInfo{"Safari", "17", "iOS", "17.4", deviceMobile}},
+		{"chrome on ipad", "Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/124.0.6367.88 Mobile/15E148 Safari/604.1",
+			userAgentInfo{"Chrome", "124", "iOS", "16.6", deviceTablet}},
+		{"samsung internet on an android phone", "Mozilla/5.0 (Linux; Android 14; SM-S918B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/24.0 Chrome/117.0.0.0 Mobile Safari/537.36",
+			userAgentInfo{"Samsung Internet", "24", "Android", "14", deviceMobile}},
+		{"android tablet", "Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			userAgentInfo{"Chrome", "124", "Android", "13", deviceTablet}},
+		{"chrome os", "Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			userAgentInfo{"Chrome", "124", "Chrome OS", "14541", deviceDesktop}},
+		{"internet explorer", "Mozilla/5.0 (Windows NT 6.3; Trident/7.0; rv:11.0) like Gecko",
+			userAgentInfo{"Internet Explorer", "11", "Windows", "8.1", deviceDesktop}},
+		{"unknown", "curl/8.4.0", userAgentInfo{"Other", "", "Other", "", deviceDesktop}},
+		{"empty", "", userAgentInfo{"Other", "", "Other", "", deviceDesktop}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseUserAgent(tt.userAgent); got != tt.want {
+				t.Errorf("parseUserAgent() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// where the daily visitor id salt is kept, "db" shares it between instances through the visitor_salts table,
+// "memory" keeps it in the process only so it is lost, and visitor ids change, on restart
+var VisitorSaltStore = envString("VISITOR_SALT_STORE", "db")
+
+// how visitor ids are derived from the client ip and user agent
+const (
+	visitorIdDailySalt = "daily_salt"
+	visitorIdStable    = "stable"
+)
+
+// saltStore hands out the salt of the current utc day, creating it when the day changes and destroying older ones
+type saltStore struct {
+	mu   sync.Mutex
+	day  string
+	salt []byte
+}
+
+var visitorSalts = &saltStore{}
+
+// current returns the salt of today, the first instance to ask for it on a new day creates it
+func (s *saltStore) current(db *sql.DB) ([]byte, error) {
+	day := time.Now().UTC().Format(time.DateOnly)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.day == day {
+		return s.salt, nil
+	}
+
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if VisitorSaltStore == "db" {
+		salt, err = storeSalt(db, day, salt)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to get visitor salt: %w", err)
+		}
+	}
+
+	s.day = day
+	s.salt = salt
+
+	return salt, nil
+}
+
+// storeSalt saves salt for day unless another instance already did, returns the stored salt and deletes older ones
+func storeSalt(db *sql.DB, day string, salt []byte) ([]byte, error) {
+	tx, err := db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO public.visitor_salts (day, salt) VALUES ($1, $2) ON CONFLICT (day) DO NOTHING", day, salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []byte
+	err = tx.QueryRow("SELECT salt FROM public.visitor_salts WHERE day = $1", day).Scan(&stored)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM public.visitor_salts WHERE day < $1", day)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, tx.Commit()
+}
+
+// hashVisitor hashes the client ip and user agent. In daily_salt mode the salt and the domain are part of the hash so
+// ids can't be reversed by brute forcing ip addresses, change every day and can't be linked between sites.
+// The stable mode is the unsalted hash, which stays the same for a visitor indefinitely.
+func hashVisitor(mode string, salt []byte, domain string, ip string, userAgent string) string {
+	h := sha256.New()
+
+	if mode != visitorIdStable {
+		h.Write(salt)
+		h.Write([]byte(domain + "\x00"))
+	}
+
+	h.Write([]byte(ip + userAgent))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func visitorIdModeSetting(mode string) siteSetting {
+	if mode != visitorIdDailySalt && mode != visitorIdStable {
+		return siteSetting{err: fmt.Errorf("visitor id mode must be %s or %s", visitorIdDailySalt, visitorIdStable)}
+	}
+
+	return siteSetting{column: "visitor_id_mode", value: mode}
+}
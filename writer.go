@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var eventColumns = []string{"timestamp", "domain", "event_name", "duration", "user_agent", "referrer", "path", "visitor_id", "session_id", "query_params", "country", "status_code", "event_data", "is_bot", "bot_reason", "browser", "browser_version", "os", "os_version", "device_type", "is_internal", "privacy_anonymized", "schema_error", "normalized_path"}
+
+var trafficColumns = []string{"timestamp", "domain", "duration", "user_agent", "referrer", "path", "query_params", "country", "status_code", "ip", "ips", "is_bot", "bot_reason", "browser", "browser_version", "os", "os_version", "device_type", "is_internal", "ip_anonymized", "privacy_anonymized", "normalized_path", "ip_spoofed"}
+
+// writers tracks the running pipeline consumers so shutdown can wait for them
+var writers sync.WaitGroup
+
+// preparedBatch holds the rows a batch of events is written as
+type preparedBatch struct {
+	events      [][]interface{}
+	traffic     [][]interface{}
+	quarantined [][]interface{}
+	drops       map[privacyDrop]int64
+	invalid     int
+}
+
+// prepareRows turns a queued event into the row values for events and, for page views, monthly_traffic.
+// Both rows are nil if the event is internal traffic that should be dropped. salt is the daily visitor id salt
+// and schemaError how the event data violates its schema, if it does.
+func prepareRows(e queuedEvent, salt []byte, schemaError error) ([]interface{}, []interface{}, error) {
+	request := e.Request
+	values, err := url.ParseQuery(request.Query)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var queryJson *string
+
+	// every key maps to all of its values, in the order they appear in the query
+	if len(values) > 0 {
+		qj, err := json.Marshal(values)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to serialize json: %w", err)
+		}
+
+		s := string(qj)
+		queryJson = &s
+	}
+
+	var edJson *string
+
+	if len(request.EventData) > 0 {
+		if json.Valid([]byte(request.EventData)) {
+			edJson = &request.EventData
+		}
+	}
+
+	var normalized *string
+
+	if request.Path != "" {
+		path := normalizedPath(normalizeDomain(request.Domain), request.Path)
+		normalized = &path
+	}
+
+	var schemaErrorText *string
+
+	if schemaError != nil {
+		schemaErrorText = emptyStrToNil(schemaError.Error())
+	}
+
+	domain := normalizeDomain(request.Domain)
+	country := GetCountry(request.ClientIp[0])
+
+	if country == "ZZ" {
+		metricZZ.inc(domain)
+	}
+
+	visitorIdMode := visitorIdDailySalt
+	ipPolicy := ipPolicyFull
+	internal := false
+
+	if s, ok := registry.resolve(domain); ok {
+		visitorIdMode = s.VisitorIdMode
+		ipPolicy = s.IpPolicy
+
+		if s.isInternal(request.ClientIp, request.ClientUserAgent) {
+			if s.InternalTraffic == internalTrafficDrop {
+				return nil, nil, nil
+			}
+
+			internal = true
+		}
+	}
+
+	// visitors that opted out are stored without anything that identifies them
+	privacyAnonymized := privacyAction(&request) == privacySignalsAnonymize
+	var visitorId *string
+	sessionId := emptyStrToNil(request.SessionId)
+
+	if privacyAnonymized {
+		sessionId = nil
+		ipPolicy = ipPolicyDrop
+	} else {
+		id := hashVisitor(visitorIdMode, salt, domain, request.ClientIp[0], request.ClientUserAgent)
+		visitorId = &id
+	}
+
+	botReason := bots.classify(request.ClientUserAgent, request.ClientIp[0])
+	ua := parseUserAgent(request.ClientUserAgent)
+
+	eventRow := []interface{}{e.Received, domain, request.EventName, intToNil(request.Duration), request.ClientUserAgent, emptyStrToNil(request.Referrer), request.Path, visitorId, sessionId, queryJson, country, request.StatusCode, edJson, botReason != "", emptyStrToNil(botReason), ua.Browser, emptyStrToNil(ua.BrowserVersion), ua.Os, emptyStrToNil(ua.OsVersion), ua.DeviceType, internal, privacyAnonymized, schemaErrorText, normalized}
+
+	if request.EventName != "page_view" {
+		return eventRow, nil, nil
+	}
+
+	// country, bot and internal traffic detection above use the full address, only what is stored is anonymized
+	ip, ips, anonymized := anonymizeIps(ipPolicy, request.ClientIp)
+
+	trafficRow := []interface{}{e.Received, domain, intToNil(request.Duration), request.ClientUserAgent, emptyStrToNil(request.Referrer), request.Path, queryJson, country, request.StatusCode, ip, ips, botReason != "", emptyStrToNil(botReason), ua.Browser, emptyStrToNil(ua.BrowserVersion), ua.Os, emptyStrToNil(ua.OsVersion), ua.DeviceType, internal, anonymized, privacyAnonymized, normalized, request.IpSpoofed}
+
+	return eventRow, trafficRow, nil
+}
+
+// copyRows writes rows into table using COPY within the given transaction
+func copyRows(tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	defer metricInsert.observeSince(time.Now(), table)
+
+	stmt, err := tx.Prepare(pq.CopyInSchema("public", table, columns...))
+
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		_, err = stmt.Exec(row...)
+
+		if err != nil {
+			_ = stmt.Close()
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+
+	if err != nil {
+		_ = stmt.Close()
+		return err
+	}
+
+	return stmt.Close()
+}
+
+// writeBatch writes all rows of a batch in a single transaction, either everything is stored or nothing is
+func writeBatch(writeDb *sql.DB, b *preparedBatch) error {
+	tx, err := writeDb.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	err = copyRows(tx, "events", eventColumns, b.events)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to copy event rows: %w", err)
+	}
+
+	err = copyRows(tx, "monthly_traffic", trafficColumns, b.traffic)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to copy traffic rows: %w", err)
+	}
+
+	err = copyRows(tx, "quarantined_events", quarantineColumns, b.quarantined)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to copy quarantined rows: %w", err)
+	}
+
+	err = countPrivacyDrops(tx, b.drops)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to count dropped events: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ingestWorker is one consumer of the pipeline. Every worker builds and writes its own batches
+// and keeps its own counters so throughput can be compared between workers.
+type ingestWorker struct {
+	id              int
+	started         time.Time
+	written         atomic.Int64
+	failed          atomic.Int64
+	batches         atomic.Int64
+	lastBatchMillis atomic.Int64
+}
+
+type workerStatus struct {
+	Id              int     `json:"id"`
+	Written         int64   `json:"written"`
+	Failed          int64   `json:"failed"`
+	Batches         int64   `json:"batches"`
+	LastBatchMillis int64   `json:"last_batch_millis"`
+	EventsPerSecond float64 `json:"events_per_second"`
+}
+
+// ingestWorkers is set by startup while the status endpoint may already be reading it
+var ingestWorkersMu sync.RWMutex
+var ingestWorkers []*ingestWorker
+
+// startWorkers starts count pipeline consumers that all write through writeDb
+func startWorkers(writeDb *sql.DB, count int) {
+	if count < 1 {
+		count = 1
+	}
+
+	workers := make([]*ingestWorker, 0, count)
+
+	for i := 0; i < count; i++ {
+		w := &ingestWorker{id: i, started: time.Now()}
+		workers = append(workers, w)
+		writers.Add(1)
+		go w.run(writeDb)
+	}
+
+	ingestWorkersMu.Lock()
+	ingestWorkers = append(ingestWorkers, workers...)
+	ingestWorkersMu.Unlock()
+
+	log.WithFields(log.Fields{"workers": count}).Info("Started ingest workers")
+}
+
+func (w *ingestWorker) status() workerStatus {
+	written := w.written.Load()
+
+	return workerStatus{
+		Id:              w.id,
+		Written:         written,
+		Failed:          w.failed.Load(),
+		Batches:         w.batches.Load(),
+		LastBatchMillis: w.lastBatchMillis.Load(),
+		EventsPerSecond: float64(written) / time.Since(w.started).Seconds(),
+	}
+}
+
+// prepareBatch turns a batch into rows. Events that can't be prepared are logged and counted as invalid, events
+// dropped because of privacy signals are counted per site and day and events violating their schema on sites
+// that quarantine them are set aside.
+func prepareBatch(batch []queuedEvent, salt []byte) *preparedBatch {
+	b := preparedBatch{
+		events:      make([][]interface{}, 0, len(batch)),
+		traffic:     make([][]interface{}, 0),
+		quarantined: make([][]interface{}, 0),
+		drops:       make(map[privacyDrop]int64),
+	}
+
+	for _, e := range batch {
+		if privacyAction(&e.Request) == privacySignalsDrop {
+			b.drops[newPrivacyDrop(e)]++
+			excludedEvents.Add(1)
+			continue
+		}
+
+		// sites that reject violations do so at ingest, events queued before that are flagged
+		mode, violation := schemaViolation(&e.Request)
+
+		if violation != nil && mode == schemaQuarantine {
+			b.quarantined = append(b.quarantined, quarantineRow(e, violation))
+			continue
+		}
+
+		eventRow, trafficRow, err := prepareRows(e, salt, violation)
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "domain": e.Request.Domain}).Error("Failed to prepare event")
+			b.invalid++
+			continue
+		}
+
+		if eventRow == nil {
+			excludedEvents.Add(1)
+			continue
+		}
+
+		b.events = append(b.events, eventRow)
+
+		if trafficRow != nil {
+			b.traffic = append(b.traffic, trafficRow)
+		}
+	}
+
+	return &b
+}
+
+// isDataError reports whether err was caused by the values of a row rather than by the database or the connection,
+// writing the same rows again can't succeed
+func isDataError(err error) bool {
+	var pqErr *pq.Error
+
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	class := pqErr.Code.Class()
+
+	return class == "22" || class == "23"
+}
+
+// flush writes a batch and updates the counters of the worker
+func (w *ingestWorker) flush(writeDb *sql.DB, batch []queuedEvent) {
+	start := time.Now()
+
+	defer inFlightEvents.Add(-int64(len(batch)))
+	defer func() {
+		w.batches.Add(1)
+		w.lastBatchMillis.Store(time.Since(start).Milliseconds())
+	}()
+
+	w.write(writeDb, batch)
+}
+
+// write prepares and writes events, retrying with a linear backoff if the write, or getting the visitor salt, fails.
+// Events rejected by the database because of their values aren't retried, they are split in halves that are
+// written separately so a single bad event can't take the rest of the batch down with it. Only events the database
+// rejected are moved to a dead letter file, other failures put the batch back on the pipeline if the spool is enabled.
+func (w *ingestWorker) write(writeDb *sql.DB, batch []queuedEvent) {
+	var prepared *preparedBatch
+	var err error
+
+	for attempt := 0; attempt <= IngestBatchRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		if prepared == nil {
+			var salt []byte
+			salt, err = visitorSalts.current(writeDb)
+
+			if err != nil {
+				metricDbErrors.inc("visitor_salt")
+			} else {
+				prepared = prepareBatch(batch, salt)
+			}
+		}
+
+		if err == nil {
+			err = writeBatch(writeDb, prepared)
+
+			if err != nil {
+				metricDbErrors.inc("write_batch")
+			}
+		}
+
+		if err == nil {
+			log.WithFields(log.Fields{"worker": w.id, "events": len(prepared.events), "traffic": len(prepared.traffic), "quarantined": len(prepared.quarantined)}).Debug("Wrote batch")
+			w.written.Add(int64(len(prepared.events)))
+			w.failed.Add(int64(prepared.invalid))
+			writtenEvents.Add(int64(len(prepared.events)))
+			failedEvents.Add(int64(prepared.invalid))
+
+			if eventSpool != nil {
+				eventSpool.ack(batch)
+			}
+
+			return
+		}
+
+		if isDataError(err) {
+			break
+		}
+
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "worker": w.id, "attempt": attempt + 1}).Warn("Failed to write batch")
+	}
+
+	if isDataError(err) && len(batch) > 1 {
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "worker": w.id, "events": len(batch)}).Warn("Batch rejected, splitting it")
+		half := len(batch) / 2
+		w.write(writeDb, batch[:half])
+		w.write(writeDb, batch[half:])
+		return
+	}
+
+	// the events aren't the problem, they stay pending in the spool and are written once the database is back
+	if eventSpool != nil && !isDataError(err) {
+		log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "worker": w.id, "events": len(batch)}).Error("Failed to write batch, retrying it from the spool")
+		go eventSpool.retry(slices.Clone(batch))
+		return
+	}
+
+	log.WithFields(log.Fields{"error": fmt.Errorf("%w", err), "worker": w.id, "events": len(batch)}).Error("Giving up on batch")
+	w.failed.Add(int64(len(batch)))
+	failedEvents.Add(int64(len(batch)))
+
+	if eventSpool != nil {
+		eventSpool.deadLetter(batch)
+	}
+}
+
+// run consumes the pipeline until it is closed, flushing whatever is left in the last batch
+func (w *ingestWorker) run(writeDb *sql.DB) {
+	defer writers.Done()
+
+	batch := make([]queuedEvent, 0, IngestBatchSize)
+	ticker := time.NewTicker(IngestFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-pipeline:
+			if !ok {
+				if len(batch) > 0 {
+					w.flush(writeDb, batch)
+				}
+
+				return
+			}
+
+			batch = append(batch, e)
+
+			if len(batch) >= IngestBatchSize {
+				w.flush(writeDb, batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(writeDb, batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}